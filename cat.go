@@ -22,6 +22,7 @@ package main
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 )
 
@@ -55,8 +56,25 @@ func cat(args []string) int {
 			errs++
 			continue
 		}
+		// The contents have already been printed by the time they're
+		// known to be corrupt, so they can't be retried; the error is
+		// reported, though.
+		contentsReader = makeMD5VerifyingReader(file, contentsReader)
 
-		_, err = io.Copy(os.Stdout, contentsReader)
+		// Compressed files are decompressed, unless they're also
+		// encrypted, in which case their contents are printed as is.
+		var r io.Reader = contentsReader
+		compressed, err := isCompressed(file)
+		if encrypted, _ := isEncrypted(file); err == nil && compressed && !encrypted {
+			r, err = makeDecompressionReader(file, contentsReader)
+		}
+		if err == nil {
+			_, err = io.Copy(os.Stdout, r)
+		}
+		if err == nil {
+			// Make sure that all of the contents were read and verified.
+			_, err = io.Copy(ioutil.Discard, contentsReader)
+		}
 		contentsReader.Close()
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "skicka: %s: %v\n", fn, err)
@@ -0,0 +1,165 @@
+//
+// compress.go
+// Copyright(c)2014-2015 Google, Inc.
+//
+// This file is part of skicka.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"fmt"
+	"github.com/google/skicka/gdrive"
+	"io"
+	"strconv"
+)
+
+// Files uploaded with "upload -compress" are compressed before they're
+// (optionally) encrypted.  The compression algorithm is recorded in the
+// compressionProperty property, and, since the Drive file's size and MD5
+// checksum are those of the compressed contents, the size and MD5
+// checksum of the local file are stored in properties as well so that
+// later syncs can compare against them.
+const (
+	compressionProperty      = "Compression"
+	uncompressedSizeProperty = "UncompressedSize"
+	uncompressedMd5Property  = "UncompressedMd5"
+)
+
+// The only compression algorithm currently supported; it's the value of
+// compressionProperty for compressed files.
+const gzipCompression = "gzip"
+
+// Compressed files that aren't encrypted are given this MIME type on
+// Drive.
+const compressedMimeType = "application/gzip"
+
+// isCompressed returns true if the given Drive file's contents are
+// compressed, or an error if they're compressed with an algorithm that
+// isn't supported.
+func isCompressed(f *gdrive.File) (bool, error) {
+	alg, err := f.GetProperty(compressionProperty)
+	if err != nil {
+		return false, nil
+	}
+	if alg != gzipCompression {
+		return false, fmt.Errorf("%s: unsupported compression algorithm %q",
+			f.Path, alg)
+	}
+	return true, nil
+}
+
+// getUncompressedSizeAndMD5 returns the size and MD5 checksum of the local
+// file that was compressed to give the contents of the given Drive file.
+func getUncompressedSizeAndMD5(f *gdrive.File) (int64, string, error) {
+	sizeString, err := f.GetProperty(uncompressedSizeProperty)
+	if err != nil {
+		return 0, "", fmt.Errorf("%s: compressed file is missing %s property",
+			f.Path, uncompressedSizeProperty)
+	}
+	size, err := strconv.ParseInt(sizeString, 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("%s: %s: %v", f.Path, uncompressedSizeProperty, err)
+	}
+	md5, err := f.GetProperty(uncompressedMd5Property)
+	if err != nil {
+		return 0, "", fmt.Errorf("%s: compressed file is missing %s property",
+			f.Path, uncompressedMd5Property)
+	}
+	return size, md5, nil
+}
+
+// setUncompressedProperties records the size and MD5 checksum of the
+// local file whose compressed contents were uploaded to the given Drive
+// file.
+func setUncompressedProperties(f *gdrive.File, size int64, md5 string) error {
+	if err := gd.UpdateProperty(f, uncompressedSizeProperty,
+		fmt.Sprintf("%d", size)); err != nil {
+		return err
+	}
+	return gd.UpdateProperty(f, uncompressedMd5Property, md5)
+}
+
+// logicalFileSize returns the size of the local file corresponding to the
+// given Drive file: that is, excluding the initialization vector of
+// encrypted files and before compression.  If it can't be determined, the
+// size of the Drive file is returned.
+func logicalFileSize(f *gdrive.File) int64 {
+	if compressed, err := isCompressed(f); err == nil && compressed {
+		if size, _, err := getUncompressedSizeAndMD5(f); err == nil {
+			return size
+		}
+		return f.FileSize
+	}
+	if encrypted, err := isEncrypted(f); err == nil && encrypted {
+		return f.FileSize - aes.BlockSize
+	}
+	return f.FileSize
+}
+
+// compressingReader returns the gzip-compressed contents of the
+// underlying reader as it's read.
+type compressingReader struct {
+	r     io.Reader
+	zw    *gzip.Writer
+	chunk []byte
+	buf   bytes.Buffer
+	eof   bool
+}
+
+func makeCompressingReader(r io.Reader) io.Reader {
+	cr := &compressingReader{r: r, chunk: make([]byte, 64*1024)}
+	cr.zw = gzip.NewWriter(&cr.buf)
+	return cr
+}
+
+func (cr *compressingReader) Read(p []byte) (int, error) {
+	// Compress more of the underlying contents until there's some
+	// compressed output to return.
+	for cr.buf.Len() == 0 && !cr.eof {
+		n, err := cr.r.Read(cr.chunk)
+		if n > 0 {
+			if _, werr := cr.zw.Write(cr.chunk[:n]); werr != nil {
+				return 0, werr
+			}
+		}
+		if err == io.EOF {
+			if err := cr.zw.Close(); err != nil {
+				return 0, err
+			}
+			cr.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	if cr.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return cr.buf.Read(p)
+}
+
+// makeDecompressionReader returns an io.Reader that decompresses the
+// contents of the given compressed Drive file, which are read from r.
+func makeDecompressionReader(f *gdrive.File, r io.Reader) (io.Reader, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", f.Path, err)
+	}
+	return zr, nil
+}
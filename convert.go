@@ -0,0 +1,196 @@
+//
+// convert.go
+// Copyright(c)2014-2015 Google, Inc.
+//
+// This file is part of skicka.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"github.com/cheggaaa/pb"
+	"github.com/google/skicka/gdrive"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Files uploaded with "upload -convert" are converted to Google Docs
+// formats, after which Drive no longer has their original size or MD5
+// checksum.  The size, MD5 checksum, and modification time of the local
+// file that was converted are therefore stored in these properties, so
+// that later uploads can tell whether it needs to be converted again.
+const (
+	sourceSizeProperty    = "SourceSize"
+	sourceMd5Property     = "SourceMd5"
+	sourceModTimeProperty = "SourceModTime"
+)
+
+// Extensions of the files that are converted with "upload -convert".
+var convertibleExtensions = map[string]bool{
+	".csv":  true,
+	".doc":  true,
+	".docx": true,
+	".odp":  true,
+	".ods":  true,
+	".odt":  true,
+	".ppt":  true,
+	".pptx": true,
+	".xls":  true,
+	".xlsx": true,
+}
+
+func isConvertible(path string) bool {
+	return convertibleExtensions[strings.ToLower(filepath.Ext(path))]
+}
+
+// isConvertedFile returns true if the given Drive file was created by
+// converting a local file.
+func isConvertedFile(f *gdrive.File) bool {
+	_, err := f.GetProperty(sourceMd5Property)
+	return err == nil && f.IsGoogleAppsFile()
+}
+
+func formatSourceModTime(t time.Time) string {
+	return normalizeModTime(t).UTC().Format(time.RFC3339Nano)
+}
+
+// getSourceProperties returns the properties that record the state of
+// the given local file when it's converted.
+func getSourceProperties(localPath string, stat os.FileInfo) ([]gdrive.Property, error) {
+	md5, err := localFileMD5Contents(localPath, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	return []gdrive.Property{
+		{Key: sourceSizeProperty, Value: fmt.Sprintf("%d", stat.Size())},
+		{Key: sourceMd5Property, Value: md5},
+		{Key: sourceModTimeProperty, Value: formatSourceModTime(stat.ModTime())},
+	}, nil
+}
+
+// convertFileUp uploads the local file in the given mapping, converting
+// it to a Google Docs format.  An existing converted file at the Drive
+// path is updated in place, so that its sharing settings and comments are
+// kept.
+func convertFileUp(fm localToRemoteFileMapping, parentFolder *gdrive.File,
+	opts uploadOptions, pb *pb.ProgressBar) (*gdrive.File, error) {
+	localPath, stat := fm.LocalPath, fm.LocalFileInfo
+
+	var proplist []gdrive.Property
+	proplist = append(proplist, gdrive.Property{Key: "Permissions",
+		Value: fmt.Sprintf("%#o", stat.Mode()&os.ModePerm)})
+	proplist = append(proplist, fm.DriveNameProps...)
+	if opts.PreserveMetadata {
+		mdprops, err := getMetadataProperties(localPath, stat)
+		if err != nil {
+			return nil, err
+		}
+		proplist = append(proplist, mdprops...)
+	}
+	srcprops, err := getSourceProperties(localPath, stat)
+	if err != nil {
+		return nil, err
+	}
+	proplist = append(proplist, srcprops...)
+
+	oldFile, err := getDriveFile(fm.DrivePath)
+	if err != nil && err != gdrive.ErrNotExist {
+		return nil, err
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	modTime, mimeType := normalizeModTime(stat.ModTime()), mimeTypeForFile(localPath, false)
+	var driveFile *gdrive.File
+	if oldFile != nil {
+		driveFile, err = gd.UpdateConvertedFile(oldFile, parentFolder, modTime, proplist,
+			mimeType, f)
+	} else {
+		driveFile, err = gd.CreateConvertedFile(fm.DriveName, parentFolder, modTime,
+			proplist, mimeType, f)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if pb != nil {
+		pb.Add64(stat.Size())
+	}
+	atomic.AddInt64(&stats.DiskReadBytes, stat.Size())
+	atomic.AddInt64(&stats.UploadBytes, stat.Size())
+	atomic.AddInt64(&stats.DriveFilesUpdated, 1)
+	return driveFile, nil
+}
+
+// convertedFileEditedOnDrive returns true if the given converted Drive
+// file has been modified on Drive (e.g., edited in the browser) since it
+// was last converted; when it's converted, its modification time is set
+// to the local file's, which is recorded in its properties.
+func convertedFileEditedOnDrive(f *gdrive.File) bool {
+	t, _ := f.GetProperty(sourceModTimeProperty)
+	return t != formatSourceModTime(f.ModTime)
+}
+
+// convertedFileNeedsUpload is the equivalent of fileNeedsUpload for Drive
+// files that were converted from local files; it compares the local file
+// to the state recorded when it was converted.
+func convertedFileNeedsUpload(localPath string, driveFile *gdrive.File,
+	stat os.FileInfo, trustTimes, dryRun bool) (bool, error) {
+	if !isConvertedFile(driveFile) {
+		return false, fmt.Errorf("%s: is a Google Apps file on Drive that "+
+			"wasn't converted by skicka; not updating it", driveFile.Path)
+	}
+
+	sizeString, _ := driveFile.GetProperty(sourceSizeProperty)
+	size, err := strconv.ParseInt(sizeString, 10, 64)
+	if err != nil || size != stat.Size() {
+		debug.Printf("%s: source size mismatch; converting again", localPath)
+		return true, nil
+	}
+
+	modTime := formatSourceModTime(stat.ModTime())
+	if t, _ := driveFile.GetProperty(sourceModTimeProperty); t == modTime && trustTimes {
+		debug.Printf("%s: size and time match converted file", localPath)
+		return false, nil
+	}
+
+	md5, err := localFileMD5Contents(localPath, false, nil)
+	if err != nil {
+		return false, err
+	}
+	if driveMd5, _ := driveFile.GetProperty(sourceMd5Property); md5 != driveMd5 {
+		debug.Printf("%s: contents differ from converted file; converting again",
+			localPath)
+		return true, nil
+	}
+
+	// Same contents, so only the recorded time needs to be updated.
+	if !dryRun {
+		if err := gd.UpdateProperty(driveFile, sourceModTimeProperty, modTime); err != nil {
+			return false, err
+		}
+		return false, gd.UpdateModificationTime(driveFile, normalizeModTime(stat.ModTime()))
+	}
+	return false, nil
+}
@@ -23,21 +23,30 @@ import (
 	"bytes"
 	"crypto/aes"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/cheggaaa/pb"
 	"github.com/google/skicka/gdrive"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 func downloadUsage() {
 	fmt.Printf("Usage: skicka download [-ignore-times] [-dry-run] [-download-google-apps-files]\n")
-	fmt.Printf("       drive_path local_path\n")
+	fmt.Printf("       [-export-format [type=]format[,...]]\n")
+	fmt.Printf("       [-keep-both | -force] [-delete] [-manifest <file>]\n")
+	fmt.Printf("       [-duplicates=skip|newest|largest|all]\n")
+	fmt.Printf("       [-min-size <size>] [-max-size <size>]\n")
+	fmt.Printf("       [-newer-than <time>] [-older-than <time>] drive_path local_path\n")
+	fmt.Printf("       skicka download [options] -tar <file>|- drive_path\n")
 	fmt.Printf("Run \"skicka help\" for more detailed help text.\n")
 }
 
@@ -46,13 +55,35 @@ func download(args []string) int {
 	ignoreTimes := false
 	downloadGoogleAppsFiles := false
 	dryRun := false
+	deleteLocal := false
+	var conflicts conflictPolicy
+	var manifestFilename, tarPath string
+	filter, err := downloadFilterFromConfig()
+	checkFatalError(err, "")
 	for i := 0; i < len(args); i++ {
-		if args[i] == "-ignore-times" {
+		if isFilter, err := parseFilterFlag(args, &i, &filter); isFilter {
+			checkFatalError(err, "")
+		} else if isDupes, err := parseDuplicatesFlag(args, &i, true); isDupes {
+			checkFatalError(err, "")
+		} else if parseConflictFlag(args[i], &conflicts) {
+			continue
+		} else if args[i] == "-manifest" && i+1 < len(args) {
+			manifestFilename = args[i+1]
+			i++
+		} else if args[i] == "-tar" && i+1 < len(args) {
+			tarPath = args[i+1]
+			i++
+		} else if args[i] == "-ignore-times" {
 			ignoreTimes = true
 		} else if args[i] == "-download-google-apps-files" {
 			downloadGoogleAppsFiles = true
+		} else if args[i] == "-export-format" && i+1 < len(args) {
+			checkFatalError(parseExportFormats(args[i+1]), "")
+			i++
 		} else if args[i] == "-dry-run" {
 			dryRun = true
+		} else if args[i] == "-delete" {
+			deleteLocal = true
 		} else if drivePath == "" {
 			drivePath = filepath.Clean(args[i])
 		} else if localPath == "" {
@@ -63,87 +94,170 @@ func download(args []string) int {
 		}
 	}
 
-	if drivePath == "" || localPath == "" {
+	if drivePath == "" || (localPath == "") != (tarPath != "") {
 		downloadUsage()
 		return 1
 	}
+	if tarPath != "" && (deleteLocal || manifestFilename != "") {
+		printErrorAndExit(fmt.Errorf("-delete and -manifest can't be used with -tar"))
+	}
 	trustTimes := !ignoreTimes
 
 	// Start out by seeing what we've got at the given path in Drive. If
-	// it's not a single file or folder, then error out.
+	// it's not a single file or folder, then error out, unless there's a
+	// policy for choosing among duplicates.
 	files := gd.GetFiles(drivePath)
 	if len(files) == 0 {
 		printErrorAndExit(fmt.Errorf("%s: not found on Drive", drivePath))
 	} else if len(files) > 1 {
-		printErrorAndExit(fmt.Errorf("%s: %d files found on Drive with this name",
-			drivePath, len(files)))
+		if duplicates == skipDuplicates {
+			printErrorAndExit(fmt.Errorf("%s: %d files found on Drive with this name",
+				drivePath, len(files)))
+		}
+		files, _ = resolveDuplicates(map[string][]*gdrive.File{files[0].Path: files},
+			duplicates)
+	}
+
+	if manifestFilename != "" && !dryRun {
+		checkFatalError(openManifest(manifestFilename), "")
 	}
 
 	syncStartTime = time.Now()
 
 	var errs int
-	if files[0].IsFolder() {
+	if tarPath != "" {
+		errs = downloadTar(drivePath, tarPath, files[0], downloadGoogleAppsFiles,
+			dryRun, filter)
+	} else if files[0].IsFolder() {
 		// Download a folder from Drive to the local system.
 		errs = syncHierarchyDown(drivePath, localPath, trustTimes,
-			downloadGoogleAppsFiles, dryRun)
+			downloadGoogleAppsFiles, dryRun, deleteLocal, conflicts, filter)
 	} else {
-		// Only download a single file.
-		stat, err := os.Stat(localPath)
-		if err == nil && stat.IsDir() {
-			// drivePath is a single file but localPath is a directory, so
-			// append the base name of the drive file to the local path.
-			localPath = path.Join(localPath, filepath.Base(drivePath))
+		if deleteLocal {
+			printErrorAndExit(fmt.Errorf("%s: -delete can only be used when "+
+				"downloading a folder", drivePath))
 		}
+		// Only download a single file (or, with -duplicates=all, each of
+		// the files with the given name).
+		stat, err := os.Stat(localPath)
+		localIsDir := err == nil && stat.IsDir()
+		for i, f := range files {
+			fileLocalPath := localPath
+			if localIsDir {
+				// drivePath is a single file but localPath is a directory,
+				// so append the base name of the drive file to the local
+				// path.
+				fileLocalPath = path.Join(localPath, localNameForDriveFile(f))
+			} else if i > 0 {
+				fileLocalPath = filepath.Join(filepath.Dir(localPath),
+					duplicateName(filepath.Base(localPath), f.Id))
+			}
 
-		if !downloadGoogleAppsFiles && files[0].IsGoogleAppsFile() {
-			message("%s: skipping Google Apps file.", files[0].Path)
-		} else {
-			err = syncOneFileDown(files[0], localPath, trustTimes, dryRun)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "skicka: %s: %s\n", drivePath, err)
-				errs++
+			if !downloadGoogleAppsFiles && f.IsGoogleAppsFile() {
+				message("%s: skipping Google Apps file.", f.Path)
+				addToManifest(manifestEntryForFile(fileLocalPath, "", f, manifestSkipped,
+					"Google Apps file"), nil)
+			} else if excluded, reason := driveFileExcluded(f, filter); excluded {
+				reportFilteredDownload(fileLocalPath, f, reason, dryRun)
+			} else {
+				if !dryRun {
+					removeStaleDownloads(filepath.Dir(fileLocalPath))
+				}
+				err = syncOneFileDown(f, fileLocalPath, trustTimes, dryRun, conflicts)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "skicka: %s: %s\n", f.Path, err)
+					errs++
+				}
 			}
 		}
 	}
 
 	printFinalStats()
+
+	if err := closeManifest(); err != nil {
+		fmt.Fprintf(os.Stderr, "skicka: %s: %v\n", manifestFilename, err)
+		errs++
+	}
 	return errs
 }
 
 // Synchronize a single file from Google Drive to the local file system at
 // `localPath`.
 func syncOneFileDown(file *gdrive.File, localPath string, trustTimes bool,
-	dryRun bool) error {
+	dryRun bool, conflicts conflictPolicy) error {
 	needsDownload, err := fileNeedsDownload(localPath, file, trustTimes)
 	if err != nil {
+		addToManifestForUnchangedFile(localPath, file, err)
 		return fmt.Errorf("%s: error determining if file needs "+
 			"download: %v\n", file.Path, err)
 	}
+	if needsDownload {
+		if needsDownload, err = resolveDownloadConflict(localPath, file, conflicts,
+			dryRun); err != nil {
+			addToManifestForUnchangedFile(localPath, file, err)
+			return err
+		}
+	}
 
 	if needsDownload {
 		if dryRun {
-			fmt.Printf("%s -> %s (%d bytes)\n", file.Path, localPath, file.FileSize)
+			fmt.Printf("%s -> %s (%d bytes)\n", file.Path, localPath,
+				logicalFileSize(file))
 			return nil
 		}
-		pb := getProgressBar(file.FileSize)
+		pb := getProgressBar(logicalFileSize(file))
 		if pb != nil {
 			defer pb.Finish()
 		}
 		return downloadFile(file, localPath, pb)
 	}
 
+	addToManifestForUnchangedFile(localPath, file, nil)
+	if isSymlinkFile(file) {
+		// Symlinks don't have permissions of their own.
+		return nil
+	}
+
 	// No download needed, but make sure the local permissions
 	// match the permissions on Drive.
 	mode, err := getPermissions(file)
 	if err != nil {
 		mode = 0644
 	}
-	return os.Chmod(localPath, mode)
+	if err := os.Chmod(localPath, mode); err != nil {
+		return err
+	}
+	if !dryRun {
+		recordSyncIfUnchanged(localPath, file)
+	}
+	return restoreLocalMetadata(localPath, file)
+}
+
+// driveFileExcluded returns true if the given Drive file is excluded from
+// downloading by the given filter, along with the reason why.
+func driveFileExcluded(f *gdrive.File, filter transferFilter) (bool, string) {
+	if f.IsFolder() {
+		return false, ""
+	}
+	// Filter on the size of the local file, which doesn't include the
+	// initialization vector of encrypted files and isn't compressed.
+	return filter.excludes(logicalFileSize(f), f.ModTime)
+}
+
+func reportFilteredDownload(localPath string, f *gdrive.File, reason string,
+	dryRun bool) {
+	if dryRun {
+		fmt.Printf("%s: skipped (%s)\n", f.Path, reason)
+	} else {
+		verbose.Printf("%s: skipping file, which is %s", f.Path, reason)
+	}
+	addToManifest(manifestEntryForFile(localPath, f.Path, f, manifestSkipped, reason), nil)
 }
 
 // Synchronize an entire folder hierarchy from Drive to a local directory.
 func syncHierarchyDown(driveBasePath string, localBasePath string, trustTimes bool,
-	downloadGoogleAppsFiles bool, dryRun bool) int {
+	downloadGoogleAppsFiles bool, dryRun bool, deleteLocal bool,
+	conflicts conflictPolicy, filter transferFilter) int {
 	// First, make sure the user isn't asking us to download a directory on
 	// top of a file.
 	if stat, err := os.Stat(localBasePath); err == nil && !stat.IsDir() {
@@ -158,53 +272,45 @@ func syncHierarchyDown(driveBasePath string, localBasePath string, trustTimes bo
 	checkFatalError(err, "error getting files from Drive")
 	message("Done. Starting download.\n")
 
-	// We won't download files where there are multiple versions of the
-	// file with the same name on Drive.  Issue warnings about any dupes
-	// here.
-	uniqueDriveFiles, dupes := gdrive.PartitionUniquesAndMultiples(filesOnDrive)
-	nDownloadErrors := int32(len(dupes))
-	for _, f := range dupes {
-		fmt.Fprintf(os.Stderr, "skicka: %s: skipping download of duplicate "+
-			"file on Drive\n", f[0].Path)
-	}
-
-	// If we're not trying to download Google Apps files (Docs, etc.),
-	// then filter them out here.
-	if !downloadGoogleAppsFiles {
-		var files []*gdrive.File
-		for _, f := range uniqueDriveFiles {
-			if f.IsGoogleAppsFile() {
-				message("%s: skipping Google Apps file.", f.Path)
-			} else {
-				files = append(files, f)
-			}
-		}
-		uniqueDriveFiles = files
+	// With -delete, local files that aren't on Drive are removed, so
+	// make sure that there's something on Drive to mirror; otherwise an
+	// emptied (or mistyped) folder would wipe out the local copy.
+	if deleteLocal && len(filesOnDrive) <= 1 {
+		printErrorAndExit(fmt.Errorf("%s: folder is empty on Drive; not "+
+			"deleting local files with -delete", driveBasePath))
 	}
 
-	// Warn that we're going to ignore any files that have slashes in their
-	// names.
-	var files []*gdrive.File
-	for _, f := range uniqueDriveFiles {
-		if f.PathHasSlash() {
-			message("%s: skipping file with slash in filename", f.Path)
-		} else {
-			files = append(files, f)
-		}
+	uniqueDriveFiles, nDownloadErrors := selectFilesToDownload(filesOnDrive,
+		downloadGoogleAppsFiles, dryRun, filter)
+
+	var localPathsOnDrive map[string]string
+	if deleteLocal {
+		// Every file on Drive counts, including ones that won't be
+		// downloaded because they're skipped duplicates, Google Apps
+		// files, or filtered out, as well as the copies of duplicates.
+		files := append(append([]*gdrive.File{}, filesOnDrive...), uniqueDriveFiles...)
+		sort.Sort(drivePathOrder(files))
+		localPathsOnDrive = createPathMap(files, localBasePath, driveBasePath)
 	}
-	uniqueDriveFiles = files
 
 	// Create a map that stores the local filename to use for each file in
 	// Google Drive. This map is indexed by the path of the Google Drive
-	// file.
+	// file.  (Files with slashes in their names are given escaped local
+	// names; see names.go.)
 	localPathMap := createPathMap(uniqueDriveFiles, localBasePath, driveBasePath)
+	uniqueDriveFiles = filesWithLocalPaths(uniqueDriveFiles, localPathMap, &nDownloadErrors)
+
+	if deleteLocal {
+		nDownloadErrors += deleteLocalFilesNotOnDrive(localBasePath,
+			localPathsOnDrive, dryRun)
+	}
 
 	if dryRun {
 		var totalBytes int64
 		for _, f := range uniqueDriveFiles {
 			fmt.Printf("%s -> %s (%d bytes)\n", f.Path, localPathMap[f.Path],
-				f.FileSize)
-			totalBytes += f.FileSize
+				logicalFileSize(f))
+			totalBytes += logicalFileSize(f)
 		}
 		fmt.Printf("Total bytes %d\n", totalBytes)
 		return 0
@@ -220,49 +326,68 @@ func syncHierarchyDown(driveBasePath string, localBasePath string, trustTimes bo
 	checkFatalError(err, "")
 
 	// Now figure out which files actually need to be downloaded and
-	// initialize filesToDownload with their corresponding gdrive.Files.
-	nBytesToDownload := int64(0)
-	var filesToDownload []*gdrive.File
-	for _, f := range uniqueDriveFiles {
-		if f.IsFolder() {
-			// Folders were aready taken care of by createLocalDirectories().
-			continue
-		}
-
-		localPath := localPathMap[f.Path]
-		needsDownload, err := fileNeedsDownload(localPath, f, trustTimes)
-		if err != nil {
-			addErrorAndPrintMessage(&nDownloadErrors,
-				fmt.Sprintf("%s: error determining if file needs download\n",
-					f.Path), err)
-			continue
-		}
+	// download them.  Checking a file may require computing the MD5
+	// checksum of its local copy, so a pool of workers does the checks
+	// and hands each file that needs downloading off to the download
+	// workers as soon as it's found; this way downloads start while the
+	// rest of the hierarchy is still being checked.
+	toCheckChan := make(chan *gdrive.File, 128)
+	toDownloadChan := make(chan *gdrive.File, 128)
+	doneChan := make(chan int, nWorkers)
 
-		if needsDownload {
-			nBytesToDownload += f.FileSize
-			filesToDownload = append(filesToDownload, f)
-		} else {
-			// No download needed, but make sure the local permissions and
-			// modified time match those values on Drive.
-			syncLocalFileMetadata(localPath, f, &nDownloadErrors)
-		}
+	// The total size of the files to download isn't known until they've
+	// all been checked, so the progress bar grows as they're found.
+	var progressBar growingProgressBar
+	nFilesToDownload := int32(0)
+	queueDownload := func(f *gdrive.File) {
+		progressBar.add(logicalFileSize(f))
+		atomic.AddInt32(&nFilesToDownload, 1)
+		toDownloadChan <- f
 	}
 
-	// Bail out early if everything is up to date.
-	if len(filesToDownload) == 0 {
-		message("Nothing to download.")
-		return 0
+	// Launch the checkers.
+	var checkers sync.WaitGroup
+	for i := 0; i < nWorkers; i++ {
+		checkers.Add(1)
+		go func() {
+			defer checkers.Done()
+			for f := range toCheckChan {
+				localPath := localPathMap[f.Path]
+				needsDownload, err := fileNeedsDownload(localPath, f, trustTimes)
+				if err != nil {
+					addErrorAndPrintMessage(&nDownloadErrors,
+						fmt.Sprintf("%s: error determining if file needs download\n",
+							f.Path), err)
+					addToManifest(manifestEntryForFile(localPath, f.Path, f, manifestFailed, ""), err)
+					continue
+				}
+				if needsDownload {
+					needsDownload, err = resolveDownloadConflict(localPath, f, conflicts, dryRun)
+					if err != nil {
+						atomic.AddInt32(&nDownloadErrors, 1)
+						fmt.Fprintf(os.Stderr, "skicka: %s\n", err)
+						addToManifestForUnchangedFile(localPath, f, err)
+						continue
+					}
+				}
+
+				if needsDownload {
+					queueDownload(f)
+				} else {
+					// No download needed, but make sure the local
+					// permissions and modified time match those values on
+					// Drive.
+					addToManifestForUnchangedFile(localPath, f, nil)
+					syncLocalFileMetadata(localPath, f, &nDownloadErrors)
+				}
+			}
+		}()
 	}
 
-	// Actually download the files. We'll use multiple workers to improve
+	// Launch the download workers. We'll use multiple workers to improve
 	// performance; we're more likely to have some workers actively
 	// downloading file contents while others are still making Drive API
 	// calls this way.
-	toDownloadChan := make(chan *gdrive.File, 128)
-	doneChan := make(chan int, nWorkers)
-	progressBar := getProgressBar(nBytesToDownload)
-
-	// Launch the workers.
 	for i := 0; i < nWorkers; i++ {
 		go func() {
 			for {
@@ -270,7 +395,7 @@ func syncHierarchyDown(driveBasePath string, localBasePath string, trustTimes bo
 				// next.
 				if f, ok := <-toDownloadChan; ok {
 					localPath := localPathMap[f.Path]
-					err := downloadFile(f, localPath, progressBar)
+					err := downloadFile(f, localPath, progressBar.get())
 					if err != nil {
 						addErrorAndPrintMessage(&nDownloadErrors, localPath, err)
 					}
@@ -283,28 +408,210 @@ func syncHierarchyDown(driveBasePath string, localBasePath string, trustTimes bo
 		}()
 	}
 
-	// Send the workers the files to be downloaded.
-	for _, f := range filesToDownload {
-		toDownloadChan <- f
+	// Send the checkers the files; folders were already taken care of by
+	// createLocalDirectories().
+	for _, f := range uniqueDriveFiles {
+		if !f.IsFolder() {
+			toCheckChan <- f
+		}
 	}
-	close(toDownloadChan)
+	close(toCheckChan)
 
-	// And now wait for the workers to all return.
+	// Once all of the files have been checked, there's nothing more to
+	// download; wait for the download workers to finish.
+	checkers.Wait()
+	close(toDownloadChan)
 	for i := 0; i < nWorkers; i++ {
 		<-doneChan
 	}
-	if progressBar != nil {
-		progressBar.Finish()
+
+	if nFilesToDownload == 0 {
+		message("Nothing to download.")
+		restoreDirectoryTimes(localPathMap, uniqueDriveFiles, &nDownloadErrors)
+		return int(nDownloadErrors)
 	}
+	progressBar.finish()
 
 	if nDownloadErrors > 0 {
 		fmt.Fprintf(os.Stderr, "skicka: %d files not downloaded due to errors\n",
 			nDownloadErrors)
 	}
+	restoreDirectoryTimes(localPathMap, uniqueDriveFiles, &nDownloadErrors)
 	return int(nDownloadErrors)
 }
 
+// restoreDirectoryTimes sets the modification times of the local
+// directories for the folders among the given files, which are sorted by
+// path, to match the folders' modification times on Drive.  Since adding,
+// removing, or renaming files in a directory updates its modification
+// time, this has to wait until all of the files in the hierarchy have been
+// written; the directories are handled deepest first, so that each one is
+// done after everything under it.
+func restoreDirectoryTimes(localPathMap map[string]string, files []*gdrive.File,
+	nErrors *int32) {
+	for i := len(files) - 1; i >= 0; i-- {
+		f := files[i]
+		if !f.IsFolder() {
+			continue
+		}
+		dirPath := localPathMap[f.Path]
+		modTime := normalizeModTime(f.ModTime)
+		debug.Printf("%s: setting modification time to %s", dirPath, modTime)
+		if err := os.Chtimes(dirPath, modTime, modTime); err != nil {
+			addErrorAndPrintMessage(nErrors, dirPath, err)
+		}
+	}
+}
+
+// deleteLocalFilesNotOnDrive removes the files and directories under
+// localBasePath whose paths aren't among the values of localPathMap, which
+// maps every file under the Drive folder being downloaded to its local
+// path.  Local copies saved because of conflicts are kept.  With dryRun,
+// it only prints what would be removed.  It returns the number of errors
+// encountered.
+func deleteLocalFilesNotOnDrive(localBasePath string, localPathMap map[string]string,
+	dryRun bool) int32 {
+	onDrive := make(map[string]bool)
+	for _, p := range localPathMap {
+		onDrive[p] = true
+	}
+
+	var nErrors int32
+	filepath.Walk(localBasePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if !os.IsNotExist(err) {
+				addErrorAndPrintMessage(&nErrors, path, err)
+			}
+			return nil
+		}
+		if path == localBasePath || onDrive[path] {
+			return nil
+		}
+		// Temporary files from earlier downloads are left to
+		// removeStaleDownloads(), so that partial downloads can still
+		// be resumed.  Local copies kept by -keep-both aren't on Drive
+		// either, but may be the only copy of the local changes.
+		if strings.HasPrefix(info.Name(), downloadTempPrefix) ||
+			isConflictName(info.Name()) {
+			return nil
+		}
+
+		if dryRun {
+			fmt.Printf("%s: delete\n", path)
+		} else {
+			verbose.Printf("%s: deleting, since it's not on Drive", path)
+			if err := os.RemoveAll(path); err != nil {
+				addErrorAndPrintMessage(&nErrors, path, err)
+			} else {
+				atomic.AddInt64(&stats.LocalFilesDeleted, 1)
+				addToManifest(manifestEntry{LocalPath: path, Size: info.Size(),
+					Action: manifestDeleted, Reason: "not on Drive"}, nil)
+			}
+		}
+		if info.IsDir() {
+			// Its contents are gone along with it.
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return nErrors
+}
+
+// selectFilesToDownload returns the files from the given ones, sorted by
+// path, that should be downloaded: duplicates are handled according to the
+// duplicates policy, and Google Apps files, unless downloadGoogleAppsFiles
+// is true, and files excluded by the filter are skipped.  It also returns
+// the number of errors, which are reported for skipped duplicates.
+func selectFilesToDownload(filesOnDrive []*gdrive.File, downloadGoogleAppsFiles bool,
+	dryRun bool, filter transferFilter) ([]*gdrive.File, int32) {
+	// Unless there's a policy for choosing among them, we won't download
+	// files where there are multiple versions of the file with the same
+	// name on Drive.  Issue warnings about any such dupes here.
+	uniqueDriveFiles, dupes := gdrive.PartitionUniquesAndMultiples(filesOnDrive)
+	resolved, skippedDupes := resolveDuplicates(dupes, duplicates)
+	nErrors := int32(len(skippedDupes))
+	for _, f := range skippedDupes {
+		fmt.Fprintf(os.Stderr, "skicka: %s: skipping download of duplicate "+
+			"file on Drive\n", f[0].Path)
+		addToManifest(manifestEntryForFile("", f[0].Path, nil, manifestSkipped,
+			"multiple files on Drive"), nil)
+	}
+	if len(resolved) > 0 {
+		uniqueDriveFiles = append(uniqueDriveFiles, resolved...)
+		sort.Sort(drivePathOrder(uniqueDriveFiles))
+	}
+
+	// If we're not trying to download Google Apps files (Docs, etc.),
+	// then filter them out here.
+	if !downloadGoogleAppsFiles {
+		var files []*gdrive.File
+		for _, f := range uniqueDriveFiles {
+			if f.IsGoogleAppsFile() {
+				message("%s: skipping Google Apps file.", f.Path)
+				addToManifest(manifestEntryForFile("", f.Path, f, manifestSkipped,
+					"Google Apps file"), nil)
+			} else {
+				files = append(files, f)
+			}
+		}
+		uniqueDriveFiles = files
+	}
+
+	// Similarly, prune the files that are excluded by the size and
+	// modification time filters.  (Folders are kept so that the local
+	// directory hierarchy is still created.)
+	var files []*gdrive.File
+	for _, f := range uniqueDriveFiles {
+		if excluded, reason := driveFileExcluded(f, filter); excluded {
+			reportFilteredDownload("", f, reason, dryRun)
+		} else {
+			files = append(files, f)
+		}
+	}
+	return files, nErrors
+}
+
+// addToManifestForUnchangedFile adds an entry to the manifest for a file
+// that isn't being downloaded, either because it's up to date or because
+// of the given error.  It must be called before the local file's metadata
+// is updated.
+func addToManifestForUnchangedFile(localPath string, f *gdrive.File, err error) {
+	action, reason := manifestSkipped, "up to date"
+	if _, ok := err.(conflictError); ok {
+		reason = "conflict"
+	} else if err != nil {
+		action, reason = manifestFailed, ""
+	} else if localMetadataDiffers(localPath, f) {
+		action, reason = manifestMetadataOnly, ""
+	}
+	addToManifest(manifestEntryForFile(localPath, f.Path, f, action, reason), err)
+}
+
+// localMetadataDiffers returns true if the permissions or modification
+// time of the local file don't match the given Drive file's.
+func localMetadataDiffers(localPath string, f *gdrive.File) bool {
+	if isSymlinkFile(f) {
+		return false
+	}
+	stat, err := os.Stat(localPath)
+	if err != nil {
+		return false
+	}
+	mode, err := getPermissions(f)
+	if err != nil {
+		mode = 0644
+	}
+	return stat.Mode()&os.ModePerm != mode ||
+		!normalizeModTime(stat.ModTime()).Equal(normalizeModTime(f.ModTime))
+}
+
 func syncLocalFileMetadata(localPath string, f *gdrive.File, nDownloadErrors *int32) {
+	if isSymlinkFile(f) {
+		// Both Chmod and Chtimes follow symlinks, so we'd end up modifying
+		// the link target.
+		return
+	}
+
 	mode, err := getPermissions(f)
 	if err != nil {
 		mode = 0644
@@ -312,14 +619,21 @@ func syncLocalFileMetadata(localPath string, f *gdrive.File, nDownloadErrors *in
 	if err := os.Chmod(localPath, mode); err != nil {
 		addErrorAndPrintMessage(nDownloadErrors, localPath, err)
 	}
+	if err := restoreLocalMetadata(localPath, f); err != nil {
+		addErrorAndPrintMessage(nDownloadErrors, localPath, err)
+	}
 
 	if err := os.Chtimes(localPath, normalizeModTime(f.ModTime), normalizeModTime(f.ModTime)); err != nil {
 		addErrorAndPrintMessage(nDownloadErrors, localPath, err)
 	}
+	recordSyncIfUnchanged(localPath, f)
 }
 
-// Create a map, indexed by Google Drive file Id, that gives the local
-// pathname to use for the corresponding Google Drive file.
+// Create a map, indexed by Google Drive file path, that gives the local
+// pathname to use for the corresponding Google Drive file.  The files
+// must be sorted by path, so that each folder comes before its contents.
+// Files whose parent folder isn't among them (other than files directly
+// under the base folder) are left out of the map.
 func createPathMap(files []*gdrive.File, localBasePath, driveBasePath string) map[string]string {
 	if driveBasePath[0] == os.PathSeparator {
 		if len(driveBasePath) > 1 {
@@ -337,7 +651,22 @@ func createPathMap(files []*gdrive.File, localBasePath, driveBasePath string) ma
 				f.Path, driveBasePath))
 		}
 		if len(f.Path) > len(driveBasePath) {
-			localPath = path.Join(localPath, f.Path[len(driveBasePath):])
+			// Because file names may contain slashes, the local path has
+			// to be built up from the parent folder's local path and the
+			// file's name, rather than from f.Path directly.
+			parentPath := strings.TrimSuffix(strings.TrimSuffix(f.Path, f.Title), "/")
+			localParent, ok := m[parentPath]
+			if !ok {
+				if parentPath != driveBasePath {
+					// The parent folder was left out (e.g., as a
+					// duplicate), so there's nowhere to put the file.
+					debug.Printf("Drive file %s [id %s]: parent folder skipped",
+						f.Path, f.Id)
+					continue
+				}
+				localParent = localBasePath
+			}
+			localPath = filepath.Join(localParent, localNameForDriveFile(f))
 		}
 		debug.Printf("Drive file %s [id %s] -> local %s", f.Path, f.Id, localPath)
 
@@ -351,6 +680,26 @@ func createPathMap(files []*gdrive.File, localBasePath, driveBasePath string) ma
 	return m
 }
 
+// errParentFolderSkipped is reported for files that aren't downloaded
+// because their parent folder isn't.
+var errParentFolderSkipped = errors.New("parent folder skipped")
+
+// filesWithLocalPaths returns the files from the given ones that have a
+// local path in the given map returned by createPathMap(), reporting an
+// error for each of the others.
+func filesWithLocalPaths(files []*gdrive.File, localPathMap map[string]string,
+	nErrors *int32) []*gdrive.File {
+	var result []*gdrive.File
+	for _, f := range files {
+		if _, ok := localPathMap[f.Path]; ok {
+			result = append(result, f)
+		} else {
+			addErrorAndPrintMessage(nErrors, f.Path, errParentFolderSkipped)
+		}
+	}
+	return result
+}
+
 func getProgressBar(nBytes int64) *pb.ProgressBar {
 	if quiet {
 		return nil
@@ -363,36 +712,319 @@ func getProgressBar(nBytes int64) *pb.ProgressBar {
 	return progressBar
 }
 
+// progressBarTotalMutex serializes changes to the totals of running
+// progress bars.
+var progressBarTotalMutex sync.Mutex
+
+// addToProgressBarTotal adds the given number of bytes, which may be
+// negative, to the total that the given progress bar expects.  It may be
+// called from multiple goroutines while the progress bar is running.
+func addToProgressBarTotal(progressBar *pb.ProgressBar, n int64) {
+	if progressBar == nil {
+		return
+	}
+	progressBarTotalMutex.Lock()
+	defer progressBarTotalMutex.Unlock()
+	progressBar.SetTotal64(atomic.LoadInt64(&progressBar.Total) + n)
+}
+
+// growingProgressBar is a progress bar for transfers that start before
+// the total size of the files to be transferred is known.  It's created
+// once there's something to transfer, and its total grows as more files
+// are found to need transferring.
+type growingProgressBar struct {
+	mutex sync.Mutex
+	bar   *pb.ProgressBar
+}
+
+// add adds the given number of bytes to the total that the progress bar
+// expects, creating it if needed, and returns it.  A nil progress bar is
+// returned if progress isn't being shown or if nothing has been added
+// yet.
+func (g *growingProgressBar) add(n int64) *pb.ProgressBar {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.bar != nil {
+		addToProgressBarTotal(g.bar, n)
+	} else if n > 0 {
+		// A progress bar that starts with a total of zero never shows a
+		// percentage.
+		g.bar = getProgressBar(n)
+	}
+	return g.bar
+}
+
+// get returns the progress bar, which is nil if it hasn't been created.
+func (g *growingProgressBar) get() *pb.ProgressBar {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.bar
+}
+
+func (g *growingProgressBar) finish() {
+	if bar := g.get(); bar != nil {
+		bar.Finish()
+	}
+}
+
+// downloadConnections limits the number of connections that are used at
+// once for the segments of segmented downloads and the files that
+// "download -tar" downloads ahead of time to nWorkers.
+var downloadConnections struct {
+	sync.Once
+	c chan struct{}
+}
+
+// acquireDownloadConnection waits until one of the connections limited by
+// downloadConnections is available and takes it.
+func acquireDownloadConnection() {
+	downloadConnections.Do(func() {
+		downloadConnections.c = make(chan struct{}, nWorkers)
+	})
+	downloadConnections.c <- struct{}{}
+}
+
+// releaseDownloadConnection makes a connection taken by
+// acquireDownloadConnection available again.
+func releaseDownloadConnection() {
+	<-downloadConnections.c
+}
+
 // Download a single file from Google Drive, saving it to the given path.
-func downloadFile(f *gdrive.File, localPath string, progressBar *pb.ProgressBar) error {
-	writeCloser, err := getLocalWriterForDriveFile(localPath, f)
+func downloadFile(f *gdrive.File, localPath string, progressBar *pb.ProgressBar) (err error) {
+	// Record the outcome in the manifest.
+	action := manifestUpdated
+	if _, err := os.Lstat(localPath); os.IsNotExist(err) {
+		action = manifestCreated
+	}
+	defer func() {
+		if err != nil {
+			action = manifestFailed
+		}
+		addToManifest(manifestEntryForFile(localPath, f.Path, f, action, ""), err)
+	}()
+
+	if isSymlinkFile(f) {
+		return createLocalSymlink(f, localPath)
+	}
+
+	// The contents are downloaded to a temporary file that's only renamed
+	// to localPath once it's complete, so that an existing local file is
+	// left as is if the download fails.  If a previous download of the
+	// file was interrupted, it continues from where that one left off:
+	// after the contents it already has or, for segmented downloads, with
+	// the segments that its segment log doesn't list.
+	segmented := useSegmentedDownload(f, localPath)
+	resumable := canResumeDownload(f)
+	tempFile, offset, err := getLocalWriterForDriveFile(localPath, f, resumable)
+	if err != nil {
+		return err
+	}
+	tempPath := tempFile.Name()
+	var segments *segmentLog
+	defer func() {
+		if segments != nil {
+			segments.close()
+		}
+		if err == nil {
+			os.Remove(segmentLogPath(tempPath))
+			return
+		}
+		// A partial download that the rest of the contents can't be
+		// requested for (because the file changed without its MD5
+		// checksum changing, presumably) is of no use either.
+		if stat, serr := os.Stat(tempPath); serr == nil && stat.Size() > 0 && resumable &&
+			!isIntegrityError(err) && err != gdrive.ErrRangeNotSatisfiable {
+			verbose.Printf("%s: keeping partial download in %s", f.Path, tempPath)
+		} else {
+			os.Remove(tempPath)
+			os.Remove(segmentLogPath(tempPath))
+		}
+	}()
+	if segmented {
+		// The segments that are already there are accounted for as
+		// they're skipped.
+		if !resumable {
+			segments = newSegmentLog()
+		} else if segments, err = openSegmentLog(tempPath); err != nil {
+			tempFile.Close()
+			return err
+		} else if offset == 0 {
+			// A new partial download; any log is from an earlier one.
+			err = segments.reset()
+		}
+		if err != nil {
+			tempFile.Close()
+			return err
+		}
+		if offset > 0 {
+			verbose.Printf("%s: resuming segmented download", f.Path)
+		}
+		offset = 0
+	}
+	if offset > 0 {
+		verbose.Printf("%s: resuming download after %d bytes", f.Path, offset)
+		if progressBar != nil {
+			progressBar.Add64(offset)
+		}
+	}
+
+	// If the downloaded contents don't match the file's MD5 checksum,
+	// they're discarded and the file is downloaded again from the start.
+	for try := 0; ; try++ {
+		err = downloadContents(tempFile, f, offset, segments, progressBar)
+		if !isIntegrityError(err) || try == maxIntegrityRetries {
+			break
+		}
+		fmt.Fprintf(os.Stderr, "skicka: %s: %v; downloading it again\n", f.Path, err)
+		if progressBar != nil {
+			if stat, serr := tempFile.Stat(); serr == nil {
+				progressBar.Add64(-stat.Size())
+			}
+		}
+		if err = tempFile.Truncate(0); err != nil {
+			break
+		}
+		if _, err = tempFile.Seek(0, os.SEEK_SET); err != nil {
+			break
+		}
+		if segments != nil {
+			if err = segments.reset(); err != nil {
+				break
+			}
+		}
+		offset = 0
+	}
 	if err != nil {
+		tempFile.Close()
+		return err
+	}
+	if config.Download.Fsync {
+		if err = tempFile.Sync(); err != nil {
+			tempFile.Close()
+			return err
+		}
+	}
+	if err = tempFile.Close(); err != nil {
 		return err
 	}
 
+	// Make sure that all of the contents were written before replacing
+	// the local file.
+	stat, err := os.Stat(tempPath)
+	if err != nil {
+		return err
+	}
+	// (Google Docs files don't have a size on Drive.)
+	if size := logicalFileSize(f); stat.Size() != size && !f.IsGoogleAppsFile() {
+		return fmt.Errorf("downloaded %d bytes but expected %d", stat.Size(), size)
+	}
+	verbose.Printf("Downloaded and wrote %d bytes to %s", stat.Size(), localPath)
+
+	// Set the file's permissions to match the permissions on Drive.
+	permissions, err := getPermissions(f)
+	if err != nil {
+		permissions = 0644
+	}
+	if err = os.Chmod(tempPath, permissions); err != nil {
+		return err
+	}
+
+	// This has to happen after the contents are written, since writing to
+	// a file clears its setuid and setgid bits.
+	if err = restoreLocalMetadata(tempPath, f); err != nil {
+		return err
+	}
+	modTime := normalizeModTime(f.ModTime)
+	if err = os.Chtimes(tempPath, modTime, modTime); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tempPath, localPath); err != nil {
+		return err
+	}
+	atomic.AddInt64(&stats.LocalFilesUpdated, 1)
+	recordSync(localPath, f, f.Md5, f.ModTime)
+	return nil
+}
+
+// downloadContents downloads the contents of the given Drive file to the
+// given temporary file, which already holds the first offset bytes of
+// them, and verifies them.  If segments isn't nil, the contents are
+// downloaded in segments, skipping the ones that it says are already in
+// the file.
+func downloadContents(tempFile *os.File, f *gdrive.File, offset int64,
+	segments *segmentLog, progressBar *pb.ProgressBar) error {
 	// Tee writes to the progress bar, which provides the Writer interface
 	// and updates itself according to the number of bytes that it sees.
 	var multiwriter io.Writer
 	if progressBar != nil {
-		multiwriter = io.MultiWriter(writeCloser, progressBar)
+		multiwriter = io.MultiWriter(tempFile, progressBar)
 	} else {
-		multiwriter = writeCloser
+		multiwriter = tempFile
 	}
 
 	// FIXME: downloadDriveFile needs a name that better distinguishes its
 	// function from downloadFile.
-	if err := downloadDriveFile(multiwriter, f); err != nil {
-		writeCloser.Close()
+	if offset == 0 && segments == nil {
+		// The contents are verified as they're downloaded.
+		return downloadDriveFile(multiwriter, f, 0)
+	}
 
-		// Remove the incomplete file from the failed download.
-		_ = os.Remove(localPath)
+	var err error
+	if segments != nil {
+		err = downloadDriveFileSegments(tempFile, f, segments, progressBar)
+	} else if offset < logicalFileSize(f) {
+		err = downloadDriveFile(multiwriter, f, offset)
+	}
+	if err != nil {
 		return err
 	}
+	// Resumed and segmented downloads don't receive the contents in a
+	// single stream, so the local file is read back to verify them.
+	return verifyDownloadedFile(tempFile.Name(), f)
+}
 
-	writeCloser.Close()
-	verbose.Printf("Downloaded and wrote %d bytes to %s", f.FileSize, localPath)
+// createLocalSymlink creates a symlink at localPath with the target stored
+// in the given Drive file, replacing any existing local file.  Note that
+// the symlink's modification time isn't restored, since there's no
+// portable way to set it without following the link.
+func createLocalSymlink(f *gdrive.File, localPath string) error {
+	target, err := getSymlinkTarget(f)
+	if err != nil {
+		return fmt.Errorf("%s: unable to get symlink target: %v", f.Path, err)
+	}
 
-	return os.Chtimes(localPath, normalizeModTime(f.ModTime), normalizeModTime(f.ModTime))
+	if stat, err := os.Lstat(localPath); err == nil && stat.IsDir() {
+		return fmt.Errorf("%s: is a directory, but %s on Drive is a "+
+			"symbolic link", localPath, f.Path)
+	}
+	if err := os.Remove(localPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Symlink(target, localPath); err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&stats.LocalFilesUpdated, 1)
+	verbose.Printf("Created symlink %s -> %s", localPath, target)
+	return nil
+}
+
+// symlinkNeedsDownload is the equivalent of fileNeedsDownload for Drive
+// files that represent symlinks; the local symlink needs to be (re)created
+// unless it exists and has the same target.
+func symlinkNeedsDownload(localPath string, driveFile *gdrive.File) (bool, error) {
+	target, err := getSymlinkTarget(driveFile)
+	if err != nil {
+		return false, fmt.Errorf("unable to get symlink target: %v", err)
+	}
+	localTarget, err := os.Readlink(localPath)
+	if err != nil {
+		debug.Printf("symlinkNeedsDownload: %s: %s. Downloading.", localPath, err)
+		return true, nil
+	}
+	return localTarget != target, nil
 }
 
 // Create all of the directories on the local filesystem for the folders in
@@ -423,6 +1055,7 @@ func createLocalDirectories(localPathMap map[string]string, files []*gdrive.File
 				return fmt.Errorf("%s: is a regular file but %s on Google Drive is a folder",
 					dirPath, f.Path)
 			}
+			removeStaleDownloads(dirPath)
 		} else {
 			// Create a local directory.
 			verbose.Printf("Creating directory %s for %s with permissions %#o",
@@ -442,6 +1075,9 @@ func createLocalDirectories(localPathMap map[string]string, files []*gdrive.File
 		if err != nil {
 			return err
 		}
+		if err = restoreLocalMetadata(dirPath, f); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -475,6 +1111,10 @@ func isEncrypted(file *gdrive.File) (bool, error) {
 // comparing file contents.
 func fileNeedsDownload(localPath string, driveFile *gdrive.File,
 	trustTimes bool) (bool, error) {
+	if isSymlinkFile(driveFile) {
+		return symlinkNeedsDownload(localPath, driveFile)
+	}
+
 	// See if the local version of the file exists at all.
 	stat, err := os.Stat(localPath)
 	if err == os.ErrNotExist {
@@ -488,19 +1128,39 @@ func fileNeedsDownload(localPath string, driveFile *gdrive.File,
 		return true, nil
 	}
 
+	// Google Docs files don't have a size or MD5 checksum on Drive, so
+	// they're downloaded if their modification times differ; their
+	// contents can't be compared.
+	if driveFile.IsGoogleAppsFile() {
+		return !trustTimes || !normalizeModTime(stat.ModTime()).Equal(
+			normalizeModTime(driveFile.ModTime)), nil
+	}
+
 	// Compare the local and Drive file sizes; if they don't match, we
 	// definitely need to download.
 	localSize := stat.Size()
 	driveSize := driveFile.FileSize
+	driveMD5 := driveFile.Md5
 
 	// Adjust driveSize for encrypted files to account for the
 	// initialization vector being stored in the first aes.BlockSize bytes
-	// of the file on Drive.
+	// of the file on Drive.  For compressed files, compare against the
+	// size and MD5 checksum of the file before it was compressed.
 	encrypt, err := isEncrypted(driveFile)
 	if err != nil {
 		return false, err
 	}
-	if encrypt {
+	compressed, err := isCompressed(driveFile)
+	if err != nil {
+		return false, err
+	}
+	if compressed {
+		if driveSize, driveMD5, err = getUncompressedSizeAndMD5(driveFile); err != nil {
+			return false, err
+		}
+		// The local file's MD5 checksum is computed without encryption.
+		encrypt = false
+	} else if encrypt {
 		driveSize -= aes.BlockSize
 	}
 
@@ -534,7 +1194,7 @@ func fileNeedsDownload(localPath string, driveFile *gdrive.File,
 	if err != nil {
 		return true, err
 	}
-	md5Mismatch := localMD5 != driveFile.Md5
+	md5Mismatch := localMD5 != driveMD5
 
 	if !trustTimes && md5Mismatch && localModificationTime.Equal(driveModificationTime) {
 		fmt.Fprintf(os.Stderr, "skicka: %s: local modification time matches "+
@@ -546,50 +1206,32 @@ func fileNeedsDownload(localPath string, driveFile *gdrive.File,
 }
 
 // Sync the given file from Google Drive to the local filesystem.
-func downloadDriveFile(writer io.Writer, driveFile *gdrive.File) error {
-	contentsReader, err := gd.GetFileContents(driveFile)
-	if contentsReader != nil {
-		defer contentsReader.Close()
-	}
+// If offset is non-zero, the local file's contents are written starting
+// at that offset, which must be less than its size; this isn't possible
+// for compressed files.
+func downloadDriveFile(writer io.Writer, driveFile *gdrive.File, offset int64) error {
+	compressed, err := isCompressed(driveFile)
 	if err != nil {
 		return err
 	}
+	if compressed && offset > 0 {
+		return fmt.Errorf("compressed files can't be downloaded starting partway through")
+	}
 
-	encrypted, err := isEncrypted(driveFile)
+	contentsReader, err := getDecryptedContentsReader(driveFile, offset, -1)
 	if err != nil {
 		return err
 	}
+	defer contentsReader.Close()
 
 	var r io.Reader
 	r = contentsReader
 
-	// Decrypt the contents, if they're encrypted.
-	if encrypted {
-		if key == nil {
-			key = decryptEncryptionKey()
-		}
-
-		// Read the initialization vector from the start of the file.
-		iv := make([]byte, 16)
-		n, err := contentsReader.Read(iv)
-		if err != nil && err != io.EOF {
+	// And then decompress them.
+	if compressed {
+		if r, err = makeDecompressionReader(driveFile, r); err != nil {
 			return err
 		}
-		if n < aes.BlockSize {
-			return fmt.Errorf("contents too short to hold IV: %d bytes", n)
-		}
-
-		// Double check that the IV matches the one in the Drive metadata.
-		ivp, err := getInitializationVector(driveFile)
-		if err != nil {
-			return err
-		}
-		if bytes.Compare(iv, ivp) != 0 {
-			return fmt.Errorf("file start IV [%s] doesn't match properties IV [%s]",
-				hex.EncodeToString(iv), hex.EncodeToString(ivp))
-		}
-
-		r = makeDecryptionReader(key, iv, r)
 	}
 
 	// Wrap the reader so that we can count how many bytes are read (in
@@ -599,39 +1241,202 @@ func downloadDriveFile(writer io.Writer, driveFile *gdrive.File) error {
 
 	// And here's where the magic happens.
 	_, err = io.Copy(writer, bcr)
+	if err == nil && compressed {
+		// Read anything left after the end of the compressed data, so
+		// that all of the contents are verified.
+		_, err = io.Copy(ioutil.Discard, contentsReader)
+	}
 
 	atomic.AddInt64(&stats.DownloadBytes, bcr.bytesRead)
 	atomic.AddInt64(&stats.DiskWriteBytes, bcr.bytesRead)
-	if err == nil {
-		atomic.AddInt64(&stats.LocalFilesUpdated, 1)
-	}
 
 	return err
 }
 
-func getLocalWriterForDriveFile(localPath string,
-	driveFile *gdrive.File) (io.WriteCloser, error) {
-	// Remove the local file, if it exists.
-	err := os.Remove(localPath)
-	if err != nil && !os.IsNotExist(err) {
+// getDecryptedContentsReader returns an io.ReadCloser that provides the
+// given number of bytes of the given Drive file's contents, starting at
+// the given offset, or through the end of the file if length is negative.
+// Encrypted contents are decrypted; the offset and length are in terms of
+// the decrypted contents.  If the whole file is read, the contents are
+// verified against its MD5 checksum as they're read.
+func getDecryptedContentsReader(driveFile *gdrive.File,
+	offset, length int64) (io.ReadCloser, error) {
+	if _, mimeType, ok := getExportFormat(driveFile); ok {
+		return gd.GetExportedFileContents(driveFile, mimeType)
+	}
+
+	encrypted, err := isEncrypted(driveFile)
+	if err != nil {
 		return nil, err
 	}
+	verify := offset == 0 && length < 0
+	if !encrypted {
+		contentsReader, err := gd.GetFileContentsRange(driveFile, offset, length)
+		if err == nil && verify {
+			contentsReader = makeMD5VerifyingReader(driveFile, contentsReader)
+		}
+		return contentsReader, err
+	}
 
-	// Create or overwrite the local file.
-	f, err := os.Create(localPath)
+	// Encrypted files start with the initialization vector, and, since
+	// they're encrypted in CFB mode, each block of ciphertext is decrypted
+	// using the previous block of ciphertext (or the IV, for the first
+	// block).  Therefore, to start decrypting partway through, start
+	// reading at the block boundary before the offset; with the IV at the
+	// start, the block read there is the one that decryption continues
+	// from.  The plaintext before the offset is then skipped.
+	skip := offset % aes.BlockSize
+	start := offset - skip
+	if length >= 0 {
+		length += skip + aes.BlockSize
+	}
+
+	contentsReader, err := gd.GetFileContentsRange(driveFile, start, length)
 	if err != nil {
+		if contentsReader != nil {
+			contentsReader.Close()
+		}
 		return nil, err
 	}
+	if verify {
+		contentsReader = makeMD5VerifyingReader(driveFile, contentsReader)
+	}
 
-	// Set the file's permissions to match the permissions on Drive.
-	permissions, err := getPermissions(driveFile)
+	if key == nil {
+		key = decryptEncryptionKey()
+	}
+
+	// Read the initialization vector (or the preceding block of
+	// ciphertext).
+	iv := make([]byte, aes.BlockSize)
+	n, err := io.ReadFull(contentsReader, iv)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		contentsReader.Close()
+		return nil, fmt.Errorf("contents too short to hold IV: %d bytes", start+int64(n))
+	} else if err != nil {
+		contentsReader.Close()
+		return nil, err
+	}
+
+	if start == 0 {
+		// Double check that the IV matches the one in the Drive metadata.
+		ivp, err := getInitializationVector(driveFile)
+		if err != nil {
+			contentsReader.Close()
+			return nil, err
+		}
+		if bytes.Compare(iv, ivp) != 0 {
+			contentsReader.Close()
+			return nil, fmt.Errorf("file start IV [%s] doesn't match properties IV [%s]",
+				hex.EncodeToString(iv), hex.EncodeToString(ivp))
+		}
+	}
+
+	r := makeDecryptionReader(key, iv, contentsReader)
+	if _, err := io.CopyN(ioutil.Discard, r, skip); err != nil {
+		contentsReader.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, contentsReader}, nil
+}
+
+// Prefix of the names of the temporary files that downloads are written
+// to; they're renamed to the local file once the download completes.
+const downloadTempPrefix = ".skicka.download."
+
+// Suffix of the names of temporary files that are kept if their downloads
+// fail, so that later downloads can resume from where they left off.
+const partialDownloadSuffix = ".partial"
+
+// Partial downloads that haven't been resumed for this long are removed
+// by removeStaleDownloads.
+const partialDownloadMaxAge = 7 * 24 * time.Hour
+
+// canResumeDownload returns true if an interrupted download of the given
+// Drive file can later be resumed.  That isn't possible for compressed
+// files, whose contents can only be decompressed from the start, or for
+// files without an MD5 checksum, for which a partial download can't be
+// matched to a particular version of the file.
+func canResumeDownload(f *gdrive.File) bool {
+	compressed, cerr := isCompressed(f)
+	_, eerr := isEncrypted(f)
+	return f.Md5 != "" && !f.IsGoogleAppsFile() && cerr == nil && !compressed &&
+		eerr == nil
+}
+
+// partialDownloadPath returns the path of the temporary file that the
+// given Drive file is downloaded to when the download can be resumed.
+// The file's MD5 checksum is included so that a partial download of an
+// older version of the file isn't resumed.
+func partialDownloadPath(localPath string, f *gdrive.File) string {
+	return filepath.Join(filepath.Dir(localPath),
+		downloadTempPrefix+f.Id+"."+f.Md5+partialDownloadSuffix)
+}
+
+// getLocalWriterForDriveFile returns a temporary file in the same
+// directory as localPath for the contents of the given Drive file to be
+// downloaded to.  If resume is true, it's the file returned by
+// partialDownloadPath, and the number of bytes of the contents that it
+// already holds from an earlier download that was interrupted is returned
+// as well.
+func getLocalWriterForDriveFile(localPath string, driveFile *gdrive.File,
+	resume bool) (*os.File, int64, error) {
+	if !resume {
+		f, err := ioutil.TempFile(filepath.Dir(localPath), downloadTempPrefix)
+		return f, 0, err
+	}
+
+	// Remove any partial downloads of other versions of the file, along
+	// with their segment logs.
+	partialPath := partialDownloadPath(localPath, driveFile)
+	others, _ := filepath.Glob(filepath.Join(filepath.Dir(localPath),
+		downloadTempPrefix+driveFile.Id+".*"))
+	for _, name := range others {
+		if name != partialPath && name != segmentLogPath(partialPath) {
+			os.Remove(name)
+		}
+	}
+
+	f, err := os.OpenFile(partialPath, os.O_WRONLY|os.O_CREATE, 0600)
 	if err != nil {
-		permissions = 0644
+		return nil, 0, err
+	}
+	offset, err := f.Seek(0, os.SEEK_END)
+	if err == nil && offset > logicalFileSize(driveFile) {
+		// Something's amiss; start over.
+		if err = f.Truncate(0); err == nil {
+			offset, err = f.Seek(0, os.SEEK_SET)
+		}
 	}
-	err = os.Chmod(localPath, permissions)
 	if err != nil {
-		_ = f.Close()
-		return nil, err
+		f.Close()
+		return nil, 0, err
+	}
+	return f, offset, nil
+}
+
+// removeStaleDownloads removes any temporary files left in the given
+// directory by downloads that were interrupted, other than recent partial
+// downloads that may still be resumed.
+func removeStaleDownloads(dir string) {
+	names, err := filepath.Glob(filepath.Join(dir, downloadTempPrefix+"*"))
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		if strings.HasSuffix(name, partialDownloadSuffix) ||
+			strings.HasSuffix(name, partialDownloadSuffix+segmentLogSuffix) {
+			if stat, err := os.Stat(name); err == nil &&
+				time.Since(stat.ModTime()) < partialDownloadMaxAge {
+				continue
+			}
+		}
+		debug.Printf("%s: removing leftover temporary file", name)
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "skicka: %s: %v\n", name, err)
+		}
 	}
-	return f, nil
 }
@@ -27,6 +27,13 @@ import (
 )
 
 func du(args []string) int {
+	// With -logical, the sizes of the local files are reported as well:
+	// those exclude encryption overhead and are before compression.
+	logical := false
+	if len(args) > 0 && args[0] == "-logical" {
+		logical = true
+		args = args[1:]
+	}
 	if len(args) == 0 {
 		args = append(args, string(os.PathSeparator))
 	}
@@ -47,9 +54,10 @@ func du(args []string) int {
 		// folderSize keeps track of the size in bytes of each folder in
 		// the hierarchy.
 		folderSize := make(map[string]int64)
+		folderLogicalSize := make(map[string]int64)
 		// dirNames tracks all of the names of directories seen so far.
 		var dirNames []string
-		totalSize := int64(0)
+		totalSize, totalLogicalSize := int64(0), int64(0)
 
 		for _, f := range files {
 			if f.IsFolder() {
@@ -58,21 +66,36 @@ func du(args []string) int {
 				// Accumulate the file's contribution to the directory it's
 				// in as well as all of the directories above it.
 				sz := f.FileSize
+				lsz := sz
+				if logical {
+					lsz = logicalFileSize(f)
+				}
 				totalSize += sz
+				totalLogicalSize += lsz
 				dirName := filepath.Clean(filepath.Dir(f.Path))
 				for ; dirName != string(os.PathSeparator) && dirName != "."; dirName = filepath.Dir(dirName) {
 					folderSize[dirName] += sz
+					folderLogicalSize[dirName] += lsz
 				}
 				folderSize[string(os.PathSeparator)] += sz
+				folderLogicalSize[string(os.PathSeparator)] += lsz
 			}
 		}
 
 		// Print output.
 		sort.Strings(dirNames)
+		printSize := func(size, logicalSize int64, path string) {
+			if logical {
+				fmt.Printf("%s  %s  %s\n", fmtbytes(size, true),
+					fmtbytes(logicalSize, true), path)
+			} else {
+				fmt.Printf("%s  %s\n", fmtbytes(size, true), path)
+			}
+		}
 		for _, d := range dirNames {
-			fmt.Printf("%s  %s\n", fmtbytes(folderSize[d], true), d)
+			printSize(folderSize[d], folderLogicalSize[d], d)
 		}
-		fmt.Printf("%s  %s\n", fmtbytes(totalSize, true), drivePath)
+		printSize(totalSize, totalLogicalSize, drivePath)
 	}
 	return errs
 }
@@ -0,0 +1,224 @@
+//
+// duplicates.go
+// Copyright(c)2014-2015 Google, Inc.
+//
+// This file is part of skicka.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"github.com/google/skicka/gdrive"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Drive allows multiple files in a folder to have the same name.  By
+// default, such files are skipped by "upload" and "download", since it's
+// not obvious which one is meant; with -duplicates, one of them is chosen
+// instead, or, for downloads, all of them are downloaded to distinct
+// local files.  Duplicate folders are merged: the contents of all of them
+// are downloaded to the same local directory, and uploads go to the chosen
+// one.
+
+// duplicatePolicy specifies what's done with files that have the same
+// path on Drive.
+type duplicatePolicy int
+
+const (
+	// Report the files as errors and skip them.
+	skipDuplicates duplicatePolicy = iota
+	// Use the most recently modified file.
+	newestDuplicate
+	// Use the largest file (or the most recently modified of the largest
+	// ones).
+	largestDuplicate
+	// Download all of the files; all but the preferred one, as chosen by
+	// newestDuplicate, have the start of their Drive file id added to their
+	// local names.
+	allDuplicates
+)
+
+// duplicates is the policy used by "upload" and "download"; it's set with
+// -duplicates.
+var duplicates duplicatePolicy
+
+// parseDuplicatesFlag handles the -duplicates flag, whose value is given
+// either as "-duplicates=policy" or in the following argument, in which
+// case *i is advanced past it.  allowAll should only be true for
+// downloads.  It returns false if args[*i] isn't the -duplicates flag.
+func parseDuplicatesFlag(args []string, i *int, allowAll bool) (bool, error) {
+	var value string
+	if strings.HasPrefix(args[*i], "-duplicates=") {
+		value = strings.TrimPrefix(args[*i], "-duplicates=")
+	} else if args[*i] == "-duplicates" {
+		if *i+1 >= len(args) {
+			return true, fmt.Errorf("-duplicates: missing value")
+		}
+		*i++
+		value = args[*i]
+	} else {
+		return false, nil
+	}
+
+	switch value {
+	case "skip":
+		duplicates = skipDuplicates
+	case "newest":
+		duplicates = newestDuplicate
+	case "largest":
+		duplicates = largestDuplicate
+	case "all":
+		if !allowAll {
+			return true, fmt.Errorf("-duplicates=all can only be used with download")
+		}
+		duplicates = allDuplicates
+	default:
+		return true, fmt.Errorf("%s: unknown -duplicates policy; must be skip, "+
+			"newest, largest, or all", value)
+	}
+	return true, nil
+}
+
+// preferDuplicate returns true if the policy prefers the Drive file a to
+// b, which has the same path.  Folders are always preferred to files, so
+// that the contents of duplicate folders have somewhere to go.
+func preferDuplicate(a, b *gdrive.File, policy duplicatePolicy) bool {
+	if a.IsFolder() != b.IsFolder() {
+		return a.IsFolder()
+	}
+	if policy == largestDuplicate && a.FileSize != b.FileSize {
+		return a.FileSize > b.FileSize
+	}
+	if !a.ModTime.Equal(b.ModTime) {
+		return a.ModTime.After(b.ModTime)
+	}
+	// Make the choice deterministic.
+	return a.Id < b.Id
+}
+
+// preferredDuplicate returns the one of the given files that the policy
+// prefers.
+func preferredDuplicate(files []*gdrive.File, policy duplicatePolicy) *gdrive.File {
+	best := files[0]
+	for _, f := range files[1:] {
+		if preferDuplicate(f, best, policy) {
+			best = f
+		}
+	}
+	return best
+}
+
+// getDriveFile is like gd.GetFile(), but if there are multiple files with
+// the given path and the policy isn't skipDuplicates, it returns the one
+// that the policy prefers, considering only the files in the folder that
+// getDriveFile returns for the parent path, if there are any.
+func getDriveFile(path string) (*gdrive.File, error) {
+	f, err := gd.GetFile(path)
+	if err != gdrive.ErrMultipleFiles || duplicates == skipDuplicates {
+		return f, err
+	}
+
+	files := gd.GetFiles(path)
+	if dir := filepath.Dir(path); dir != path {
+		if parent, err := getDriveFile(dir); err == nil {
+			var inParent []*gdrive.File
+			for _, f := range files {
+				for _, id := range f.ParentIds {
+					if id == parent.Id {
+						inParent = append(inParent, f)
+						break
+					}
+				}
+			}
+			if len(inParent) > 0 {
+				files = inParent
+			}
+		}
+	}
+	return preferredDuplicate(files, duplicates), nil
+}
+
+// resolveDuplicates applies the policy to the sets of files with the same
+// paths returned by gdrive.PartitionUniquesAndMultiples().  It returns the
+// files that should be downloaded, with the preferred one of each set
+// before the copies of the others, and the sets of files that are
+// skipped.
+func resolveDuplicates(dupes map[string][]*gdrive.File,
+	policy duplicatePolicy) ([]*gdrive.File, [][]*gdrive.File) {
+	var paths []string
+	for p := range dupes {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	var files []*gdrive.File
+	var skipped [][]*gdrive.File
+	for _, p := range paths {
+		set := dupes[p]
+		if policy == skipDuplicates {
+			skipped = append(skipped, set)
+			continue
+		}
+
+		best := preferredDuplicate(set, policy)
+		files = append(files, best)
+		for _, f := range set {
+			if f == best || f.IsFolder() {
+				// Duplicate folders are merged.
+				continue
+			}
+			if policy == allDuplicates {
+				files = append(files, duplicateCopy(f))
+			} else {
+				verbose.Printf("%s: skipping duplicate file [id %s] in favor of [id %s]",
+					f.Path, f.Id, best.Id)
+			}
+		}
+	}
+	return files, skipped
+}
+
+// duplicateCopy returns a copy of the given Drive file whose name, and
+// thus its local name, has the start of its file id added, so that it's
+// distinct from the other files with the same name.
+func duplicateCopy(f *gdrive.File) *gdrive.File {
+	c := *f
+	name := strings.TrimSuffix(f.Title, encryptionSuffix)
+	c.Title = duplicateName(name, f.Id) + f.Title[len(name):]
+	c.Path = strings.TrimSuffix(f.Path, f.Title) + c.Title
+	return &c
+}
+
+// duplicateName adds "~" and the start of the given file id to the given
+// name, before its extension; e.g., "report.txt" becomes
+// "report~1a2b3c4d.txt".
+func duplicateName(name, id string) string {
+	if len(id) > 8 {
+		id = id[:8]
+	}
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "~" + id + ext
+}
+
+// drivePathOrder sorts Drive files by path, so that folders come before
+// their contents.
+type drivePathOrder []*gdrive.File
+
+func (a drivePathOrder) Len() int           { return len(a) }
+func (a drivePathOrder) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a drivePathOrder) Less(i, j int) bool { return a[i].Path < a[j].Path }
@@ -557,8 +557,7 @@ func compare(patha, pathb string) error {
 			}
 
 			// compare modification times
-			// FIXME: there's a bug for directories, so only check files for now
-			if !stata.IsDir() && stata.ModTime() != statb.ModTime() {
+			if stata.ModTime() != statb.ModTime() {
 				log.Printf("%s: mod time %s mismatches "+
 					"%s mod time %s\n", pa, stata.ModTime().String(),
 					pb, statb.ModTime().String())
@@ -0,0 +1,145 @@
+//
+// export.go
+// Copyright(c)2014-2015 Google, Inc.
+//
+// This file is part of skicka.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"github.com/google/skicka/gdrive"
+	"sort"
+	"strings"
+)
+
+// Google Docs files don't have contents of their own; "download" exports
+// them to one of the formats that Drive offers for their type, chosen
+// with -export-format, and adds the format's extension to the local name.
+
+// exportFormats maps the MIME type of each kind of Google Docs file to
+// the formats it can be exported to, given by their extensions, and the
+// corresponding export MIME types.
+var exportFormats = map[string]map[string]string{
+	"application/vnd.google-apps.document": {
+		"docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		"md":   "text/markdown",
+		"odt":  "application/vnd.oasis.opendocument.text",
+		"pdf":  "application/pdf",
+		"txt":  "text/plain",
+	},
+	"application/vnd.google-apps.spreadsheet": {
+		"csv":  "text/csv",
+		"ods":  "application/x-vnd.oasis.opendocument.spreadsheet",
+		"pdf":  "application/pdf",
+		"xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	},
+	"application/vnd.google-apps.presentation": {
+		"pdf":  "application/pdf",
+		"pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	},
+	"application/vnd.google-apps.drawing": {
+		"png": "image/png",
+		"svg": "image/svg+xml",
+	},
+}
+
+// exportFormatChoices gives the format that each kind of Google Docs file
+// is exported to; the defaults can be changed with -export-format.
+var exportFormatChoices = map[string]string{
+	"application/vnd.google-apps.document":     "docx",
+	"application/vnd.google-apps.spreadsheet":  "xlsx",
+	"application/vnd.google-apps.presentation": "pptx",
+	"application/vnd.google-apps.drawing":      "svg",
+}
+
+const googleAppsMimeTypePrefix = "application/vnd.google-apps."
+
+// parseExportFormats handles the argument to -export-format, which is a
+// comma-separated list of either "type=format", where type is "document",
+// "spreadsheet", "presentation", or "drawing", or just "format", which
+// applies to all of the types that can be exported to it.
+func parseExportFormats(arg string) error {
+	for _, spec := range strings.Split(arg, ",") {
+		format := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(spec), "."))
+		if i := strings.Index(format, "="); i >= 0 {
+			mimeType := googleAppsMimeTypePrefix + format[:i]
+			format = format[i+1:]
+			formats, ok := exportFormats[mimeType]
+			if !ok {
+				return fmt.Errorf("%s: unknown Google Docs file type in -export-format",
+					spec)
+			}
+			if _, ok := formats[format]; !ok {
+				return fmt.Errorf("%s: unsupported export format; must be one of %s",
+					spec, strings.Join(formatNames(formats), ", "))
+			}
+			exportFormatChoices[mimeType] = format
+			continue
+		}
+
+		found := false
+		for mimeType, formats := range exportFormats {
+			if _, ok := formats[format]; ok {
+				exportFormatChoices[mimeType] = format
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: unknown export format", spec)
+		}
+	}
+	return nil
+}
+
+func formatNames(formats map[string]string) []string {
+	var names []string
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// getExportFormat returns the extension and MIME type of the format that
+// the given Google Docs file is exported to, or false if there's no
+// export format for its type.
+func getExportFormat(f *gdrive.File) (string, string, bool) {
+	if !f.IsGoogleAppsFile() {
+		return "", "", false
+	}
+	format, ok := exportFormatChoices[f.MimeType]
+	if !ok {
+		return "", "", false
+	}
+	return format, exportFormats[f.MimeType][format], true
+}
+
+// exportExtension returns the extension to add to the local name of the
+// given Drive file: for Google Docs files, it's that of the format it's
+// exported to, unless the file's name already ends with it (as files
+// converted by "upload -convert" may).
+func exportExtension(f *gdrive.File) string {
+	format, _, ok := getExportFormat(f)
+	if !ok {
+		return ""
+	}
+	ext := "." + format
+	if strings.HasSuffix(strings.ToLower(f.Title), ext) {
+		return ""
+	}
+	return ext
+}
@@ -0,0 +1,167 @@
+//
+// filter.go
+// Copyright(c)2014-2015 Google, Inc.
+//
+// This file is part of skicka.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// transferFilter excludes files from uploads and downloads based on their
+// sizes and modification times.  Zero values mean that there's no limit.
+type transferFilter struct {
+	MinSize   int64
+	MaxSize   int64
+	NewerThan time.Time
+	OlderThan time.Time
+}
+
+// excludes returns true if a file with the given size and modification
+// time should be skipped, along with a description of why.
+func (tf transferFilter) excludes(size int64, modTime time.Time) (bool, string) {
+	switch {
+	case tf.MinSize > 0 && size < tf.MinSize:
+		return true, fmt.Sprintf("smaller than %s", fmtbytes(tf.MinSize, false))
+	case tf.MaxSize > 0 && size > tf.MaxSize:
+		return true, fmt.Sprintf("larger than %s", fmtbytes(tf.MaxSize, false))
+	case !tf.NewerThan.IsZero() && !modTime.After(tf.NewerThan):
+		return true, fmt.Sprintf("not modified since %s", tf.NewerThan.Format(time.RFC3339))
+	case !tf.OlderThan.IsZero() && !modTime.Before(tf.OlderThan):
+		return true, fmt.Sprintf("modified since %s", tf.OlderThan.Format(time.RFC3339))
+	}
+	return false, ""
+}
+
+// set updates the filter setting corresponding to the given option name
+// (as used for both command-line flags and in the config file) using the
+// given value.
+func (tf *transferFilter) set(name, value string) error {
+	var err error
+	switch name {
+	case "min-size":
+		tf.MinSize, err = parseSize(value)
+	case "max-size":
+		tf.MaxSize, err = parseSize(value)
+	case "newer-than":
+		tf.NewerThan, err = parseTimeLimit(value, time.Now())
+	case "older-than":
+		tf.OlderThan, err = parseTimeLimit(value, time.Now())
+	default:
+		return fmt.Errorf("%s: unknown filter", name)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// filterFromConfig returns a transferFilter initialized from the given
+// values from the config file.
+func filterFromConfig(minSize, maxSize, newerThan, olderThan string) (transferFilter, error) {
+	var tf transferFilter
+	for _, o := range []struct{ name, value string }{
+		{"min-size", minSize}, {"max-size", maxSize},
+		{"newer-than", newerThan}, {"older-than", olderThan}} {
+		if o.value != "" {
+			if err := tf.set(o.name, o.value); err != nil {
+				return tf, err
+			}
+		}
+	}
+	return tf, nil
+}
+
+func uploadFilterFromConfig() (transferFilter, error) {
+	return filterFromConfig(config.Upload.Min_size, config.Upload.Max_size,
+		config.Upload.Newer_than, config.Upload.Older_than)
+}
+
+func downloadFilterFromConfig() (transferFilter, error) {
+	return filterFromConfig(config.Download.Min_size, config.Download.Max_size,
+		config.Download.Newer_than, config.Download.Older_than)
+}
+
+// parseFilterFlag handles the command-line flags that set the given
+// filter; if args[*i] is one of them, its value is taken from the
+// following argument and *i is advanced past it.  It returns false if the
+// argument isn't a filter flag.
+func parseFilterFlag(args []string, i *int, tf *transferFilter) (bool, error) {
+	switch args[*i] {
+	case "-min-size", "-max-size", "-newer-than", "-older-than":
+	default:
+		return false, nil
+	}
+	if *i+1 >= len(args) {
+		return true, fmt.Errorf("%s: missing value", args[*i])
+	}
+	err := tf.set(strings.TrimPrefix(args[*i], "-"), args[*i+1])
+	*i++
+	return true, err
+}
+
+// parseSize parses a size in bytes, optionally with a suffix giving a
+// unit: "k", "m", "g", or "t" (or "kb", "mb", etc.), using powers of 1024.
+func parseSize(s string) (int64, error) {
+	str := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "b")
+	mult := int64(1)
+	if n := len(str); n > 0 {
+		switch str[n-1] {
+		case 'k':
+			mult = 1 << 10
+		case 'm':
+			mult = 1 << 20
+		case 'g':
+			mult = 1 << 30
+		case 't':
+			mult = 1 << 40
+		}
+		if mult > 1 {
+			str = str[:n-1]
+		}
+	}
+	v, err := strconv.ParseFloat(str, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("%q: invalid size", s)
+	}
+	return int64(v * float64(mult)), nil
+}
+
+// parseTimeLimit parses either a duration before the given time (e.g.,
+// "36h" or "7d") or a date ("2015-06-01" or an RFC 3339 time).
+func parseTimeLimit(s string, now time.Time) (time.Time, error) {
+	if strings.HasSuffix(s, "d") {
+		if days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64); err == nil {
+			return now.Add(-time.Duration(days * float64(24*time.Hour))), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("%q: expected a duration (e.g., \"36h\" or "+
+		"\"7d\") or a date (e.g., \"2015-06-01\")", s)
+}
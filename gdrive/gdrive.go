@@ -69,6 +69,9 @@ const metadataVersion = 2
 type File struct {
 	// Path name on Drive. Does not start with a slash.
 	Path string
+	// The file's name on Drive (i.e., the last component of Path, though
+	// it may itself contain slashes.)
+	Title string
 	// Indicates whether the original file name in Drive had a slash in it.
 	pathHasSlash bool
 	// Size of the file in bytes.
@@ -109,14 +112,16 @@ func newFile(path string, f *drive.File) *File {
 	}
 
 	return &File{
-		Path:       path,
-		FileSize:   f.FileSize,
-		Id:         f.Id,
-		Md5:        f.Md5Checksum,
-		MimeType:   f.MimeType,
-		ModTime:    modTime,
-		ParentIds:  parentIds,
-		Properties: properties,
+		Path:         path,
+		Title:        f.Title,
+		pathHasSlash: strings.ContainsRune(f.Title, '/'),
+		FileSize:     f.FileSize,
+		Id:           f.Id,
+		Md5:          f.Md5Checksum,
+		MimeType:     f.MimeType,
+		ModTime:      modTime,
+		ParentIds:    parentIds,
+		Properties:   properties,
 	}
 }
 
@@ -186,6 +191,11 @@ func (a byPath) Less(i, j int) bool { return a[i].Path < a[j].Path }
 var ErrNotExist = errors.New("file does not exist")
 var ErrMultipleFiles = errors.New("multiple files on Drive")
 
+// ErrRangeNotSatisfiable is returned when the contents of a file are
+// requested starting past their end, as may happen when resuming the
+// download of a file that has changed since.
+var ErrRangeNotSatisfiable = errors.New("requested range not satisfiable")
+
 ///////////////////////////////////////////////////////////////////////////
 // GDrive
 
@@ -206,6 +216,10 @@ type GDrive struct {
 	// directories on Drive. Note that multiple files may have the same
 	// path on Drive.
 	pathToFile map[string][]*File
+	// Size of the chunks sent by UploadFileContentsResumable() and whether
+	// it should be adjusted according to the observed upload throughput.
+	uploadChunkSize   int
+	adaptiveChunkSize bool
 }
 
 ///////////////////////////////////////////////////////////////////////////
@@ -298,9 +312,10 @@ func New(uploadBytesPerSecond, downloadBytesPerSecond int,
 	debug func(s string, args ...interface{}), client *http.Client,
 	metadataCacheFilename string, quiet bool) (*GDrive, error) {
 	gd := &GDrive{
-		debug:  debug,
-		quiet:  quiet,
-		client: client,
+		debug:           debug,
+		quiet:           quiet,
+		client:          client,
+		uploadChunkSize: DefaultUploadChunkSize,
 	}
 
 	var err error
@@ -565,6 +580,8 @@ func (gd *GDrive) UpdateMetadataCache(filename string) error {
 			// declaration for an issue with this approach, though.
 			file := new(File)
 			*file = *f
+			// Before this point, f.Path holds just the file's name.
+			file.Title = f.Path
 			file.pathHasSlash = strings.ContainsRune(f.Path, '/')
 			file.Path = p
 
@@ -965,9 +982,57 @@ func (gd *GDrive) getFolderContentsRecursive(parentFolder *File, files *[]*File)
 	}
 }
 
+// Formats that GetFileContents exports Google Docs files to, in order of
+// preference: Docs, Sheets, and Slides are exported to .docx, .xlsx, and
+// .pptx formats, respectively, and Drawings to SVG.
+var defaultExportMimeTypes = []string{
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	"image/svg+xml",
+}
+
+// GetExportedFileContents returns an io.ReadCloser that provides the
+// contents of the given Google Docs file, exported to the format with the
+// given MIME type.
+func (gd *GDrive) GetExportedFileContents(f *File, mimeType string) (io.ReadCloser, error) {
+	// As with GetFileContentsRange(), get a fresh set of export links.
+	driveFile, err := gd.getFileById(f.Id)
+	if err != nil {
+		return nil, err
+	}
+	return gd.exportFile(f, driveFile, mimeType)
+}
+
+func (gd *GDrive) exportFile(f *File, driveFile *drive.File,
+	mimeType string) (io.ReadCloser, error) {
+	url, ok := driveFile.ExportLinks[mimeType]
+	if !ok {
+		return nil, fmt.Errorf("%s: can't be exported as %s", f.Path, mimeType)
+	}
+	body, _, err := gd.getURLContents(url, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	// Rate-limit the download, if required.
+	return makeLimitedDownloadReader(body), nil
+}
+
 // GetFileContents returns an io.ReadCloser that provides the contents of
 // the given File.
 func (gd *GDrive) GetFileContents(f *File) (io.ReadCloser, error) {
+	return gd.GetFileContentsRange(f, 0, -1)
+}
+
+// GetFileContentsRange returns an io.ReadCloser that provides the given
+// number of bytes of the contents of the given File, starting at the
+// given offset; if length is negative, the contents through the end of
+// the file are provided.  If the connection fails partway through the
+// download, the rest of the contents are requested again from where it
+// left off.  Google Docs files are exported rather than downloaded; they
+// can only be read in their entirety and their downloads can't be
+// resumed.
+func (gd *GDrive) GetFileContentsRange(f *File, offset, length int64) (io.ReadCloser, error) {
 	// The file download URL expires some hours after it's retrieved, so we
 	// can't really cache it.  Re-grab the full *drive.File right before
 	// downloading it so that we have a fresh URL.
@@ -978,49 +1043,197 @@ func (gd *GDrive) GetFileContents(f *File) (io.ReadCloser, error) {
 
 	url := driveFile.DownloadUrl
 	if url == "" {
+		if offset != 0 || length >= 0 {
+			return nil, fmt.Errorf("%s: Google Docs files can't be downloaded "+
+				"in parts", f.Path)
+		}
+
 		// Google Docs files can't be downloaded directly via DownloadUrl,
 		// but can be exported to another format that can be downloaded.
-
-		// Docs, Sheets, and Slides can be downloaded into .docx, .xls,
-		// and .pptx formats, respectively. This may be a bit confusing since
-		// they won't have that suffix locally.
-		for mt, u := range driveFile.ExportLinks {
-			if strings.HasPrefix(mt, "application/vnd.openxmlformats-officedocument") {
-				url = u
-				break
-			}
-		}
-		// Google Drawings can be downloaded in SVG form.
-		if url == "" {
-			if u, ok := driveFile.ExportLinks["image/svg+xml"]; ok {
-				url = u
+		for _, mimeType := range defaultExportMimeTypes {
+			if _, ok := driveFile.ExportLinks[mimeType]; ok {
+				return gd.exportFile(f, driveFile, mimeType)
 			}
 		}
 		// Otherwise we seem to be out of luck.
-		if url == "" {
-			return nil, fmt.Errorf("%s: unable to download Google Docs file", f.Path)
-		}
+		return nil, fmt.Errorf("%s: unable to download Google Docs file", f.Path)
+	}
+
+	end := f.FileSize
+	if length >= 0 {
+		end = offset + length
+	}
+	rr := &resumingReader{
+		gd:     gd,
+		path:   f.Path,
+		end:    end,
+		toEOF:  length < 0,
+		offset: offset,
+		getURL: func() (string, error) {
+			df, err := gd.getFileById(f.Id)
+			if err != nil {
+				return "", err
+			}
+			return df.DownloadUrl, nil
+		},
+	}
+	if err := rr.open(url); err != nil {
+		return nil, err
 	}
+	return rr, nil
+}
 
+// getURLContents issues a GET request for the given URL, asking for the
+// contents starting at the given offset and ending before the given end
+// offset, if it's non-zero.  It returns the response body and the offset
+// that the returned contents actually start at, which is zero if the
+// server ignored the requested range.
+func (gd *GDrive) getURLContents(url string, offset, end int64) (io.ReadCloser, int64, error) {
 	for try := 0; ; try++ {
 		request, err := http.NewRequest("GET", url, nil)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
+		}
+		if end > 0 {
+			request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, end-1))
+		} else if offset > 0 {
+			request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
 		}
 
 		resp, err := gd.client.Do(request)
+		if err == nil && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			// Trying again won't help.
+			resp.Body.Close()
+			return nil, 0, ErrRangeNotSatisfiable
+		}
 
 		switch gd.handleHTTPResponse(resp, err, try) {
 		case Success:
-			// Rate-limit the download, if required.
-			return makeLimitedDownloadReader(resp.Body), nil
+			if offset > 0 && resp.StatusCode != http.StatusPartialContent {
+				return resp.Body, 0, nil
+			}
+			return resp.Body, offset, nil
 		case Fail:
-			return nil, err
+			if err == nil {
+				resp.Body.Close()
+				err = fmt.Errorf("%s: %s", url, resp.Status)
+			}
+			return nil, 0, err
 		case Retry:
+			if resp != nil {
+				resp.Body.Close()
+			}
 		}
 	}
 }
 
+// Number of times in a row that resumingReader tries to resume a download
+// without getting any more of the file's contents before giving up.
+const maxResumeTries = 5
+
+// resumingReader provides the contents of a file being downloaded; if
+// reading the HTTP response body fails partway through, the rest of the
+// contents are requested with a Range header.
+type resumingReader struct {
+	gd   *GDrive
+	path string
+	// Offset of the end of the contents to be read; zero if it isn't
+	// known.
+	end int64
+	// Indicates whether the contents through the end of the file are
+	// wanted, in which case requests don't give an end offset.
+	toEOF bool
+	// Offset of the next byte to be read.
+	offset int64
+	body   io.ReadCloser
+	// Returns an up-to-date download URL for the file.
+	getURL func() (string, error)
+	tries  int
+}
+
+// open starts reading the contents from the given URL at rr.offset.
+func (rr *resumingReader) open(url string) error {
+	var end int64
+	if rr.end > rr.offset && !rr.toEOF {
+		end = rr.end
+	}
+	body, start, err := rr.gd.getURLContents(url, rr.offset, end)
+	if err != nil {
+		return err
+	}
+	if start < rr.offset {
+		// The server sent the whole file; skip ahead to where we want to
+		// be.
+		if _, err := io.CopyN(ioutil.Discard, body, rr.offset-start); err != nil {
+			body.Close()
+			return err
+		}
+	}
+	// Rate-limit the download, if required.
+	rr.body = makeLimitedDownloadReader(body)
+	return nil
+}
+
+func (rr *resumingReader) Read(p []byte) (int, error) {
+	for {
+		if rr.body == nil {
+			return 0, io.ErrClosedPipe
+		}
+		if rr.end > 0 {
+			// Don't read past the end, in case the server ignored the
+			// requested range.
+			if rr.offset >= rr.end {
+				return 0, io.EOF
+			}
+			if remaining := rr.end - rr.offset; int64(len(p)) > remaining {
+				p = p[:remaining]
+			}
+		}
+		n, err := rr.body.Read(p)
+		rr.offset += int64(n)
+		if n > 0 {
+			rr.tries = 0
+		}
+		if err == io.EOF && rr.end > 0 && rr.offset < rr.end {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+
+		// The connection failed; ask for the rest of the contents.
+		if rr.tries == maxResumeTries {
+			return n, err
+		}
+		rr.gd.debug("%s: error after %d bytes; resuming download: %v", rr.path,
+			rr.offset, err)
+		rr.body.Close()
+		rr.body = nil
+		rr.gd.exponentialBackoff(rr.tries, nil, err)
+		rr.tries++
+
+		url, uerr := rr.getURL()
+		if uerr == nil {
+			uerr = rr.open(url)
+		}
+		if uerr != nil {
+			return n, uerr
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (rr *resumingReader) Close() error {
+	if rr.body == nil {
+		return nil
+	}
+	err := rr.body.Close()
+	rr.body = nil
+	return err
+}
+
 // UpdateProperty updates the property with name 'key' to the value 'value'
 // in the given file on Google Drive.
 func (gd *GDrive) UpdateProperty(f *File, key string, value string) error {
@@ -1086,6 +1299,19 @@ func (gd *GDrive) AddProperty(key, value string, f *File) error {
 	}
 }
 
+// DeleteProperty removes the property with the given key from the given
+// file on Google Drive.
+func (gd *GDrive) DeleteProperty(f *File, key string) error {
+	for try := 0; ; try++ {
+		err := gd.svc.Properties.Delete(f.Id, key).Do()
+		if err == nil {
+			return nil
+		} else if err = gd.tryToHandleDriveAPIError(err, try); err != nil {
+			return fmt.Errorf("unable to delete %s property: %v", key, err)
+		}
+	}
+}
+
 // http://stackoverflow.com/questions/18578768/403-rate-limit-on-insert-sometimes-succeeds
 // Sometimes when we get a 403 error from Files.Insert().Do(), a file is
 // actually created. Delete the file to be sure we don't have duplicate
@@ -1131,6 +1357,13 @@ func (gd *GDrive) CreateFile(name string, parent *File,
 		"application/octet-stream")
 }
 
+// CreateFileWithMimeType is like CreateFile, but the new file is given the
+// specified MIME type rather than "application/octet-stream".
+func (gd *GDrive) CreateFileWithMimeType(name string, parent *File,
+	modTime time.Time, proplist []Property, mimeType string) (*File, error) {
+	return gd.createFileOrFolder(name, parent, modTime, proplist, mimeType)
+}
+
 // CreateFolder creates a new folder in Google Drive with given name.
 func (gd *GDrive) CreateFolder(name string, parent *File,
 	modTime time.Time, proplist []Property) (*File, error) {
@@ -1161,8 +1394,111 @@ func (gd *GDrive) createFileOrFolder(name string, parent *File,
 	if err != nil {
 		return nil, err
 	}
+	return gd.addToMetadataCache(f, parent), nil
+}
+
+// CopyFile creates a copy of the given file in the given folder, with the
+// given name, modification time, and properties; the file's contents are
+// copied on the server, without being transferred. Note that the copy may
+// also have some or all of the original file's properties.
+func (gd *GDrive) CopyFile(f *File, name string, parent *File,
+	modTime time.Time, proplist []Property) (*File, error) {
+	path := canonicalPath(filepath.Join(parent.Path, name))
+
+	gd.metadataMutex.Lock()
+	defer gd.metadataMutex.Unlock()
+
+	if _, ok := gd.pathToFile[path]; ok {
+		return nil, fmt.Errorf("%s: already exists", path)
+	}
+
+	df := &drive.File{
+		Title:        name,
+		ModifiedDate: modTime.UTC().Format(timeFormat),
+		Parents:      []*drive.ParentReference{&drive.ParentReference{Id: parent.Id}},
+		Properties:   convertProplist(proplist),
+	}
+	for try := 0; ; try++ {
+		r, err := gd.svc.Files.Copy(f.Id, df).Do()
+		if err == nil {
+			gd.debug("Copied %s to %s: ID=%s", f.Path, path, r.Id)
+			return gd.addToMetadataCache(r, parent), nil
+		} else if err = gd.tryToHandleDriveAPIError(err, try); err != nil {
+			return nil, fmt.Errorf("%s: unable to copy: %v", f.Path, err)
+		}
+	}
+}
+
+// CreateConvertedFile creates a new file in the given folder with the
+// given name, modification time, and properties, converting the given
+// contents, which have the given MIME type, to the corresponding Google
+// Docs format.
+func (gd *GDrive) CreateConvertedFile(name string, parent *File, modTime time.Time,
+	proplist []Property, mimeType string, contents io.ReadSeeker) (*File, error) {
+	df := &drive.File{
+		Title:        name,
+		MimeType:     mimeType,
+		ModifiedDate: modTime.UTC().Format(timeFormat),
+		Parents:      []*drive.ParentReference{&drive.ParentReference{Id: parent.Id}},
+		Properties:   convertProplist(proplist),
+	}
+
+	for try := 0; ; try++ {
+		if _, err := contents.Seek(0, 0); err != nil {
+			return nil, err
+		}
+		r := makeLimitedUploadReader(ioutil.NopCloser(contents))
+		f, err := gd.svc.Files.Insert(df).Convert(true).Media(r).Do()
+		if err == nil {
+			gd.debug("Created converted Google Drive file for %s: ID=%s", name, f.Id)
+
+			gd.metadataMutex.Lock()
+			defer gd.metadataMutex.Unlock()
+			return gd.addToMetadataCache(f, parent), nil
+		}
+		if err = gd.tryToHandleDriveAPIError(err, try); err != nil {
+			return nil, fmt.Errorf("%s: unable to convert: %v", name, err)
+		}
+	}
+}
 
-	// Update the metadata cache to account for the new file.
+// UpdateConvertedFile replaces the contents of the given file, which is
+// in the given folder and was created by CreateConvertedFile, by
+// converting the given contents, and updates its modification time and
+// properties.  The file keeps its ID, and thus its sharing settings,
+// comments, and revision history.
+func (gd *GDrive) UpdateConvertedFile(f *File, parent *File, modTime time.Time,
+	proplist []Property, mimeType string, contents io.ReadSeeker) (*File, error) {
+	df := &drive.File{
+		MimeType:     mimeType,
+		ModifiedDate: modTime.UTC().Format(timeFormat),
+		Properties:   convertProplist(proplist),
+	}
+
+	for try := 0; ; try++ {
+		if _, err := contents.Seek(0, 0); err != nil {
+			return nil, err
+		}
+		r := makeLimitedUploadReader(ioutil.NopCloser(contents))
+		u, err := gd.svc.Files.Update(f.Id, df).Convert(true).SetModifiedDate(true).
+			Media(r).Do()
+		if err == nil {
+			gd.debug("Updated converted Google Drive file %s", f.Path)
+
+			gd.metadataMutex.Lock()
+			defer gd.metadataMutex.Unlock()
+			return gd.replaceInMetadataCache(u, parent, f), nil
+		}
+		if err = gd.tryToHandleDriveAPIError(err, try); err != nil {
+			return nil, fmt.Errorf("%s: unable to convert: %v", f.Path, err)
+		}
+	}
+}
+
+// addToMetadataCache adds the given newly-created file in the given parent
+// folder to the metadata cache and returns the corresponding File.  The
+// caller must hold metadataMutex.
+func (gd *GDrive) addToMetadataCache(f *drive.File, parent *File) *File {
 	file := newFile(canonicalPath(filepath.Join(parent.Path, f.Title)), f)
 
 	// Update the pathToFile map.
@@ -1181,12 +1517,25 @@ func (gd *GDrive) createFileOrFolder(name string, parent *File,
 	for i, dirFile := range gd.dirToFiles[parent.Path] {
 		if dirFile.Path == file.Path {
 			gd.dirToFiles[parent.Path][i] = file
-			return file, nil
+			return file
 		}
 	}
 
 	gd.dirToFiles[parent.Path] = append(gd.dirToFiles[parent.Path], file)
-	return file, nil
+	return file
+}
+
+// replaceInMetadataCache adds the given new or updated file in the given
+// parent folder to the metadata cache in place of the existing file old,
+// which may have other files with the same name alongside it, and returns
+// the corresponding File.  The caller must hold metadataMutex.
+func (gd *GDrive) replaceInMetadataCache(f *drive.File, parent *File, old *File) *File {
+	file := newFile(canonicalPath(filepath.Join(parent.Path, f.Title)), f)
+	gd.pathToFile[file.Path] = append(removeFileWithId(gd.pathToFile[file.Path], old.Id),
+		file)
+	gd.dirToFiles[parent.Path] = append(removeFileWithId(gd.dirToFiles[parent.Path], old.Id),
+		file)
+	return file
 }
 
 func (gd *GDrive) insertFile(f *drive.File) (*drive.File, error) {
@@ -1207,6 +1556,81 @@ func (gd *GDrive) insertFile(f *drive.File) (*drive.File, error) {
 	}
 }
 
+// MoveFile moves the given file (which must not be a folder) into the
+// given folder, giving it the provided name; this is done entirely on the
+// server, without transferring the file's contents. The returned File
+// represents the file at its new location.
+func (gd *GDrive) MoveFile(f *File, newParent *File, newName string) (*File, error) {
+	if f.IsFolder() {
+		return nil, fmt.Errorf("%s: can't move folders", f.Path)
+	}
+	newPath := canonicalPath(filepath.Join(newParent.Path, newName))
+
+	gd.metadataMutex.Lock()
+	defer gd.metadataMutex.Unlock()
+
+	if _, ok := gd.pathToFile[newPath]; ok {
+		return nil, fmt.Errorf("%s: already exists", newPath)
+	}
+
+	// Find the parent folder that corresponds to the file's current path;
+	// the file may have other parents that should be left alone.  The
+	// file's title may itself contain slashes, so the parent's path is
+	// what's left after removing the title rather than filepath.Dir().
+	oldDir := canonicalPath(strings.TrimSuffix(strings.TrimSuffix(f.Path, f.Title), "/"))
+	var oldParentId string
+	for _, p := range gd.pathToFile[oldDir] {
+		for _, id := range f.ParentIds {
+			if p.Id == id {
+				oldParentId = id
+			}
+		}
+	}
+	if oldParentId == "" {
+		return nil, fmt.Errorf("%s: unable to find parent folder", f.Path)
+	}
+
+	var df *drive.File
+	for try := 0; ; try++ {
+		var err error
+		call := gd.svc.Files.Patch(f.Id, &drive.File{Title: newName})
+		if newParent.Id != oldParentId {
+			call = call.AddParents(newParent.Id).RemoveParents(oldParentId)
+		}
+		df, err = call.Do()
+		if err == nil {
+			break
+		} else if err = gd.tryToHandleDriveAPIError(err, try); err != nil {
+			return nil, fmt.Errorf("%s: unable to move: %v", f.Path, err)
+		}
+	}
+	gd.debug("moved %s to %s", f.Path, newPath)
+
+	// Update the metadata cache: remove the file from its old location
+	// and add it at the new one.
+	gd.pathToFile[f.Path] = removeFileWithId(gd.pathToFile[f.Path], f.Id)
+	if len(gd.pathToFile[f.Path]) == 0 {
+		delete(gd.pathToFile, f.Path)
+	}
+	gd.dirToFiles[oldDir] = removeFileWithId(gd.dirToFiles[oldDir], f.Id)
+
+	file := newFile(newPath, df)
+	gd.pathToFile[newPath] = append(gd.pathToFile[newPath], file)
+	gd.dirToFiles[newParent.Path] = append(gd.dirToFiles[newParent.Path], file)
+	return file, nil
+}
+
+// Returns the given files, less the one (if any) with the given Id.
+func removeFileWithId(files []*File, id string) []*File {
+	var result []*File
+	for _, f := range files {
+		if f.Id != id {
+			result = append(result, f)
+		}
+	}
+	return result
+}
+
 // DeleteFile deletes the given file from Google Drive; note that deletion
 // is permanent and un-reversable!  (Consider TrashFile instead.)
 func (gd *GDrive) DeleteFile(f *File) error {
@@ -27,6 +27,13 @@
 package gdrive
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"google.golang.org/api/drive/v2"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"sort"
 	"testing"
 )
@@ -63,3 +70,130 @@ func TestGetSortedUnique(t *testing.T) {
 	}
 
 }
+
+func TestReplaceInMetadataCache(t *testing.T) {
+	// Replacing one of several files with the same name leaves the
+	// others alone.
+	parent := &File{Path: "dir", Id: "dir"}
+	a := &File{Path: "dir/doc", Title: "doc", Id: "a"}
+	b := &File{Path: "dir/doc", Title: "doc", Id: "b"}
+	gd := &GDrive{
+		pathToFile: map[string][]*File{"dir": {parent}, "dir/doc": {a, b}},
+		dirToFiles: map[string][]*File{"dir": {a, b}},
+	}
+	f := gd.replaceInMetadataCache(&drive.File{Id: "c", Title: "doc"}, parent, a)
+	if f.Path != "dir/doc" {
+		t.Fatalf("Expected path dir/doc, got %s", f.Path)
+	}
+	for _, files := range [][]*File{gd.pathToFile["dir/doc"], gd.dirToFiles["dir"]} {
+		if len(files) != 2 || files[0] != b || files[1] != f {
+			t.Fatalf("Expected files b and c, got %v", files)
+		}
+	}
+}
+
+// flakyDownloadServer is an http.RoundTripper that serves the given
+// contents, honoring Range headers; the first "failures" responses fail
+// after sending half of what was requested.
+type flakyDownloadServer struct {
+	contents []byte
+	failures int
+	ranges   []string
+	requests int
+}
+
+type failingReader struct {
+	r io.Reader
+}
+
+func (fr failingReader) Read(p []byte) (int, error) {
+	n, err := fr.r.Read(p)
+	if err == io.EOF {
+		err = errors.New("connection reset")
+	}
+	return n, err
+}
+
+func (s *flakyDownloadServer) RoundTrip(req *http.Request) (*http.Response, error) {
+	s.requests++
+	resp := &http.Response{Header: make(http.Header), Request: req, StatusCode: 200}
+	start, end := 0, len(s.contents)-1
+	if r := req.Header.Get("Range"); r != "" {
+		s.ranges = append(s.ranges, r)
+		if _, err := fmt.Sscanf(r, "bytes=%d-%d", &start, &end); err != nil &&
+			err != io.ErrUnexpectedEOF && err != io.EOF {
+			return nil, err
+		}
+		resp.StatusCode = http.StatusPartialContent
+	}
+	if start >= len(s.contents) {
+		resp.StatusCode = http.StatusRequestedRangeNotSatisfiable
+		resp.Body = ioutil.NopCloser(bytes.NewReader(nil))
+		return resp, nil
+	}
+
+	contents := s.contents[start : end+1]
+	if s.failures > 0 {
+		s.failures--
+		resp.Body = ioutil.NopCloser(failingReader{bytes.NewReader(contents[:len(contents)/2])})
+	} else {
+		resp.Body = ioutil.NopCloser(bytes.NewReader(contents))
+	}
+	return resp, nil
+}
+
+func TestResumingReader(t *testing.T) {
+	contents := getRandomBytes(10000)
+	for _, r := range []struct {
+		offset, end int64
+		toEOF       bool
+	}{{0, 10000, true}, {1234, 10000, true}, {0, 10000, false}, {1234, 5000, false}} {
+		offset := r.offset
+		server := &flakyDownloadServer{contents: contents, failures: 1}
+		gd := &GDrive{
+			client: &http.Client{Transport: server},
+			debug:  func(s string, args ...interface{}) {},
+		}
+		rr := &resumingReader{gd: gd, path: "file", end: r.end, toEOF: r.toEOF,
+			offset: offset,
+			getURL: func() (string, error) { return "https://example.com/file", nil }}
+		if err := rr.open("https://example.com/file"); err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		b, err := ioutil.ReadAll(rr)
+		rr.Close()
+		if err != nil {
+			t.Fatalf("offset %d: %v", offset, err)
+		}
+		if !bytes.Equal(b, contents[offset:r.end]) {
+			t.Fatalf("offset %d: contents don't match", offset)
+		}
+		expected := fmt.Sprintf("bytes=%d-%d", offset+(r.end-offset)/2, r.end-1)
+		if r.toEOF {
+			expected = fmt.Sprintf("bytes=%d-", offset+(r.end-offset)/2)
+		}
+		if n := len(server.ranges); n == 0 || server.ranges[n-1] != expected {
+			t.Fatalf("offset %d: expected last request for %s, got %v", offset,
+				expected, server.ranges)
+		}
+		// The whole file is requested without a Range header.
+		if offset == 0 && r.toEOF && len(server.ranges) != 1 {
+			t.Fatalf("Expected no Range header for the whole file, got %v",
+				server.ranges)
+		}
+	}
+
+	// Requests past the end of the contents fail without being retried.
+	server := &flakyDownloadServer{contents: contents}
+	gd := &GDrive{
+		client: &http.Client{Transport: server},
+		debug:  func(s string, args ...interface{}) {},
+	}
+	rr := &resumingReader{gd: gd, path: "file", end: 20000, toEOF: true, offset: 15000}
+	if err := rr.open("https://example.com/file"); err != ErrRangeNotSatisfiable {
+		t.Fatalf("Expected ErrRangeNotSatisfiable, got %v", err)
+	}
+	if server.requests != 1 {
+		t.Fatalf("Expected 1 request, got %d", server.requests)
+	}
+}
@@ -175,6 +175,10 @@ type somewhatSeekableReader struct {
 	R                       io.Reader
 	buf                     []byte
 	readOffset, writeOffset int64
+	// Offsets before minOffset can't be seeked to, even if they're within
+	// len(buf) of writeOffset; this happens after the buffer is grown by
+	// Resize(), until enough new data has been read to fill it.
+	minOffset int64
 }
 
 func makeSomewhatSeekableReader(r io.Reader, maxSeek int) *somewhatSeekableReader {
@@ -215,6 +219,13 @@ func (ssr *somewhatSeekableReader) Read(b []byte) (int, error) {
 		// we've copied.
 		b = b[nCopy:]
 		ssr.readOffset += int64(nCopy)
+
+		if len(b) == 0 {
+			// Don't go to the underlying reader if there's no room left;
+			// it may return io.EOF even though there are still buffered
+			// bytes after the ones we just copied.
+			return nCopy, nil
+		}
 	}
 
 	// Once we're through the values we have buffered from previous reads,
@@ -270,7 +281,7 @@ func (ssr *somewhatSeekableReader) SeekTo(offset int64) error {
 		// really necessary currently...
 		return fmt.Errorf("invalid seek to %d, past current write offset %d",
 			offset, ssr.writeOffset)
-	case ssr.writeOffset-offset > int64(len(ssr.buf)):
+	case ssr.writeOffset-offset > int64(len(ssr.buf)) || offset < ssr.minOffset:
 		return fmt.Errorf("can't seek back to %d; current offset %d",
 			offset, ssr.writeOffset)
 	default:
@@ -278,3 +289,49 @@ func (ssr *somewhatSeekableReader) SeekTo(offset int64) error {
 		return nil
 	}
 }
+
+// Resize changes the size of the ring buffer so that subsequent seeks can
+// go back up to maxSeek bytes from the current write offset.  As much of
+// the previously-read data as fits in the new buffer is preserved; an
+// error is returned if maxSeek is too small to hold the data between the
+// current read offset and the write offset.
+func (ssr *somewhatSeekableReader) Resize(maxSeek int) error {
+	if maxSeek == len(ssr.buf) {
+		return nil
+	}
+	if ssr.writeOffset-ssr.readOffset > int64(maxSeek) {
+		return fmt.Errorf("can't resize seek buffer to %d bytes; %d bytes "+
+			"are pending", maxSeek, ssr.writeOffset-ssr.readOffset)
+	}
+
+	// Figure out how many of the most recently read bytes we can carry
+	// over to the new buffer.
+	keep := ssr.writeOffset - ssr.minOffset
+	if keep > int64(len(ssr.buf)) {
+		keep = int64(len(ssr.buf))
+	}
+	if keep > int64(maxSeek) {
+		keep = int64(maxSeek)
+	}
+
+	// Copy them over in contiguous runs, since the wrap-around points of
+	// the old and new ring buffers generally differ.
+	buf := make([]byte, maxSeek)
+	oldSize, newSize := int64(len(ssr.buf)), int64(maxSeek)
+	for offset := ssr.writeOffset - keep; offset < ssr.writeOffset; {
+		src, dst := offset%oldSize, offset%newSize
+		n := ssr.writeOffset - offset
+		if n > oldSize-src {
+			n = oldSize - src
+		}
+		if n > newSize-dst {
+			n = newSize - dst
+		}
+		copy(buf[dst:dst+n], ssr.buf[src:src+n])
+		offset += n
+	}
+
+	ssr.buf = buf
+	ssr.minOffset = ssr.writeOffset - keep
+	return nil
+}
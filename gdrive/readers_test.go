@@ -61,3 +61,75 @@ func TestSeekableReader(t *testing.T) {
 		}
 	}
 }
+
+func TestSeekableReaderResize(t *testing.T) {
+	bufSize := 65536
+	b := getRandomBytes(bufSize)
+
+	for iter := 0; iter <= 1000; iter++ {
+		maxSeek := 128 + (mrand.Int() % 4096)
+		sr := makeSomewhatSeekableReader(bytes.NewReader(b), maxSeek)
+
+		// Track how far into b we've read and the earliest offset that
+		// should still be available for seeking.
+		offset, writeOffset, minOffset := 0, 0, 0
+		for writeOffset < bufSize-100 {
+			wanted := 1 + mrand.Int()%(bufSize-offset)
+			rbuf := make([]byte, wanted)
+			n, err := sr.Read(rbuf)
+			if n != wanted {
+				t.Fatalf("Expected read of %d, got %d (err %v)", wanted, n, err)
+			}
+			if bytes.Compare(rbuf, b[offset:offset+wanted]) != 0 {
+				t.Fatalf("Didn't get back expected bytes")
+			}
+			offset += n
+			if offset > writeOffset {
+				writeOffset = offset
+			}
+			if writeOffset-maxSeek > minOffset {
+				minOffset = writeOffset - maxSeek
+			}
+
+			// Grow or shrink the buffer; the most recently read bytes
+			// that fit in the new buffer should remain available.
+			oldSeek := maxSeek
+			maxSeek = 128 + (mrand.Int() % 4096)
+			if maxSeek < writeOffset-offset {
+				maxSeek = writeOffset - offset
+			}
+			if err := sr.Resize(maxSeek); err != nil {
+				t.Fatalf("Resize %d -> %d failed: %v", oldSeek, maxSeek, err)
+			}
+			if writeOffset-maxSeek > minOffset {
+				minOffset = writeOffset - maxSeek
+			}
+
+			// Seek back as far as possible; the following read checks
+			// that we get the right bytes from there.
+			if err := sr.SeekTo(int64(minOffset)); err != nil {
+				t.Fatalf("SeekTo %d after resize failed: %v", minOffset, err)
+			}
+			offset = minOffset
+
+			if minOffset > 0 {
+				if err := sr.SeekTo(int64(minOffset - 1)); err == nil {
+					t.Fatalf("Unexpectedly able to seek to %d", minOffset-1)
+				}
+			}
+		}
+	}
+}
+
+func TestSeekableReaderResizeTooSmall(t *testing.T) {
+	sr := makeSomewhatSeekableReader(bytes.NewReader(getRandomBytes(1024)), 512)
+	if _, err := sr.Read(make([]byte, 512)); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if err := sr.SeekTo(0); err != nil {
+		t.Fatalf("SeekTo failed: %v", err)
+	}
+	if err := sr.Resize(256); err == nil {
+		t.Fatalf("Expected error when shrinking buffer below pending bytes")
+	}
+}
@@ -27,8 +27,88 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"time"
 )
 
+// UploadChunkSizeMultiple gives the granularity of the chunks sent with
+// the resumable upload protocol: the size of every chunk other than the
+// last one must be a multiple of it.
+const UploadChunkSizeMultiple = 256 * 1024
+
+// DefaultUploadChunkSize is the chunk size used for resumable uploads if
+// SetUploadChunkSize() isn't called.
+const DefaultUploadChunkSize = 1024 * 1024
+
+// With adaptive chunk sizes, chunks are sized so that each one takes
+// roughly targetChunkDuration to upload at the throughput measured for the
+// previous chunk, up to a maximum of maxAdaptiveChunkSize bytes.
+const targetChunkDuration = 4 * time.Second
+const maxAdaptiveChunkSize = 64 * 1024 * 1024
+
+// SetUploadChunkSize sets the size of the chunks of file contents sent
+// with each request by UploadFileContentsResumable().  chunkSize must be a
+// positive multiple of UploadChunkSizeMultiple.  If adaptive is true,
+// chunkSize is only used for the first chunk of each file; subsequent
+// chunks are made larger or smaller depending on the measured upload
+// throughput and on whether uploading the previous chunk failed.
+func (gd *GDrive) SetUploadChunkSize(chunkSize int, adaptive bool) error {
+	if chunkSize <= 0 || chunkSize%UploadChunkSizeMultiple != 0 {
+		return fmt.Errorf("upload chunk size %d is not a positive multiple of %d",
+			chunkSize, UploadChunkSizeMultiple)
+	}
+	gd.uploadChunkSize = chunkSize
+	gd.adaptiveChunkSize = adaptive
+	return nil
+}
+
+// chunkSizer keeps track of the size of the chunk to upload next in a
+// resumable upload.  If adaptive sizing isn't enabled, the size never
+// changes.
+type chunkSizer struct {
+	size     int
+	adaptive bool
+}
+
+// update is called after each chunk upload attempt with the number of
+// bytes that Drive reported as received, the time the request took, and
+// whether the request was successful.
+func (cs *chunkSizer) update(sent int64, elapsed time.Duration, ok bool) {
+	if !cs.adaptive {
+		return
+	}
+
+	size := cs.size
+	if !ok {
+		// Back off after errors; smaller chunks mean that less has to be
+		// resent after the next failure.
+		size = cs.size / 2
+	} else if sent > 0 && elapsed > 0 {
+		// Aim for targetChunkDuration per chunk at the throughput we just
+		// saw, but don't move too quickly in either direction based on a
+		// single measurement.
+		bytesPerSecond := float64(sent) / elapsed.Seconds()
+		size = int(bytesPerSecond * targetChunkDuration.Seconds())
+		if size > 2*cs.size {
+			size = 2 * cs.size
+		} else if size < cs.size/2 {
+			size = cs.size / 2
+		}
+	}
+
+	maxSize := maxAdaptiveChunkSize
+	if cs.size > maxSize {
+		// The user asked for a larger starting size; respect that.
+		maxSize = cs.size
+	}
+	size -= size % UploadChunkSizeMultiple
+	if size < UploadChunkSizeMultiple {
+		size = UploadChunkSizeMultiple
+	} else if size > maxSize {
+		size = maxSize
+	}
+	cs.size = size
+}
+
 // UploadFileContents uploads the file contents given by the io.Reader to
 // the given File.  The upload may fail due to various transient network
 // errors; as such, the caller should check to see if a non-nil returned
@@ -42,7 +122,7 @@ func (gd *GDrive) UploadFileContents(f *File, contentsReader io.Reader,
 	contentsReader = makeLimitedUploadReader(ioutil.NopCloser(contentsReader))
 
 	// Get the PUT request for the upload.
-	req, err := prepareUploadPUT(f.Id, contentsReader, length)
+	req, err := prepareUploadPUT(f.Id, f.MimeType, contentsReader, length)
 	if err != nil {
 		return err
 	}
@@ -80,7 +160,7 @@ func (gd *GDrive) UploadFileContents(f *File, contentsReader io.Reader,
 	}
 }
 
-func prepareUploadPUT(id string, contentsReader io.Reader,
+func prepareUploadPUT(id string, mimeType string, contentsReader io.Reader,
 	length int64) (*http.Request, error) {
 	params := make(url.Values)
 	params.Set("uploadType", "media")
@@ -89,7 +169,7 @@ func prepareUploadPUT(id string, contentsReader io.Reader,
 		url.QueryEscape(id))
 	urls += "?" + params.Encode()
 
-	contentsReader, contentType, err := detectContentType(contentsReader)
+	contentsReader, contentType, err := detectContentType(contentsReader, mimeType)
 	if err != nil {
 		return nil, err
 	}
@@ -102,7 +182,12 @@ func prepareUploadPUT(id string, contentsReader io.Reader,
 	return req, nil
 }
 
-func detectContentType(contentsReader io.Reader) (io.Reader, string, error) {
+// detectContentType returns the content type to use when uploading the
+// contents from the given Reader along with a Reader that returns the
+// same contents.  If the file's MIME type was set when it was created, it's
+// used; otherwise the type is detected from the start of the contents.  A
+// nil Reader is returned if the contents are empty.
+func detectContentType(contentsReader io.Reader, mimeType string) (io.Reader, string, error) {
 	// Grab the start of the contents so that we can try to identify
 	// the content type.
 	contentsHeader := make([]byte, 512)
@@ -114,7 +199,10 @@ func detectContentType(contentsReader io.Reader) (io.Reader, string, error) {
 		}
 		return nil, "", err
 	}
-	contentType := http.DetectContentType(contentsHeader)
+	contentType := mimeType
+	if contentType == "" || contentType == "application/octet-stream" {
+		contentType = http.DetectContentType(contentsHeader[:headerLength])
+	}
 
 	// Reconstruct a new Reader that returns the same byte stream
 	// as the original one, effectively pasting the bytes we read for
@@ -126,6 +214,16 @@ func detectContentType(contentsReader io.Reader) (io.Reader, string, error) {
 	return contentsReader, contentType, nil
 }
 
+// Returns the total length to use in a Content-Range header for a
+// resumable upload; negative lengths indicate that the length isn't known
+// yet.
+func rangeTotal(length int64) string {
+	if length < 0 {
+		return "*"
+	}
+	return fmt.Sprintf("%d", length)
+}
+
 func (gd *GDrive) getResumableUploadURI(f *drive.File, contentType string,
 	length int64) (string, error) {
 	params := make(url.Values)
@@ -141,7 +239,9 @@ func (gd *GDrive) getResumableUploadURI(f *drive.File, contentType string,
 	}
 
 	req, _ := http.NewRequest("PUT", urls, body)
-	req.Header.Set("X-Upload-Content-Length", fmt.Sprintf("%d", length))
+	if length >= 0 {
+		req.Header.Set("X-Upload-Content-Length", fmt.Sprintf("%d", length))
+	}
 	req.Header.Set("X-Upload-Content-Type", contentType)
 	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
 	req.Header.Set("User-Agent", "skicka/0.1")
@@ -186,7 +286,7 @@ func (gd *GDrive) getCurrentChunkStart(sessionURI string, contentLength int64,
 	var err error
 	for r := 0; r < maxRetries; r++ {
 		req, _ := http.NewRequest("PUT", sessionURI, nil)
-		req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", contentLength))
+		req.Header.Set("Content-Range", "bytes */"+rangeTotal(contentLength))
 		req.Header.Set("Content-Length", "0")
 		req.ContentLength = 0
 		req.Header.Set("User-Agent", "skicka/0.1")
@@ -316,12 +416,20 @@ func (gd *GDrive) handleResumableUploadResponse(resp *http.Response, err error,
 // for files under a few megabytes, but is helpful for large files in that
 // it's more robust to transient errors and can handle OAuth2 token
 // refreshes in the middle of an upload, unlike the regular approach.
+//
+// If contentLength is negative, the length of the contents isn't known in
+// advance (e.g., when they're being read from a pipe); they're then
+// uploaded until the Reader returns io.EOF.
 func (gd *GDrive) UploadFileContentsResumable(file *File,
 	contentsReader io.Reader, contentLength int64) error {
-	contentsReader, contentType, err := detectContentType(contentsReader)
+	contentsReader, contentType, err := detectContentType(contentsReader, file.MimeType)
 	if err != nil {
 		return err
 	}
+	if contentsReader == nil {
+		// Empty file--we're done.
+		return nil
+	}
 
 	sessionURI, err := gd.getResumableUploadURI(file.driveFile(), contentType,
 		contentLength)
@@ -329,20 +437,17 @@ func (gd *GDrive) UploadFileContentsResumable(file *File,
 		return err
 	}
 
-	// TODO: what is a reasonable default here? Must be 256kB minimum.
-	chunkSize := 1024 * 1024
+	sizer := chunkSizer{size: gd.uploadChunkSize, adaptive: gd.adaptiveChunkSize}
 
-	seekableReader := makeSomewhatSeekableReader(contentsReader, 2*chunkSize)
+	// Buffer enough of the file contents to be able to go back and
+	// resend a chunk after an error. (The extra byte allows peeking just
+	// past the end of a chunk when the content length isn't known.)
+	seekableReader := makeSomewhatSeekableReader(contentsReader, 2*sizer.size+1)
 
-	// Upload the file in chunks of size chunkSize (or smaller, for the
+	// Upload the file in chunks of size sizer.size (or smaller, for the
 	// very last chunk).
-	for currentOffset, try := int64(0), 0; currentOffset < contentLength; try++ {
-		end := currentOffset + int64(chunkSize)
-		if end > contentLength {
-			end = contentLength
-		}
-		gd.debug("%s: uploading chunk %d - %d...", file.Path,
-			currentOffset, end)
+	for currentOffset, try := int64(0), 0; contentLength < 0 || currentOffset < contentLength; try++ {
+		chunkSize := sizer.size
 
 		// We should usually already be at the current offset; this
 		// seek should be a no-op except in cases where the
@@ -352,6 +457,36 @@ func (gd *GDrive) UploadFileContentsResumable(file *File,
 			return err
 		}
 
+		// If the chunk size has changed, keep the seek buffer at twice
+		// its size.
+		if err = seekableReader.Resize(2*chunkSize + 1); err != nil {
+			return err
+		}
+
+		if contentLength < 0 {
+			// Drive needs to be told the total length along with the
+			// last chunk, so read one byte past this chunk to find out
+			// whether the contents end within it.
+			n, err := io.CopyN(ioutil.Discard, seekableReader, int64(chunkSize)+1)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if n <= int64(chunkSize) {
+				contentLength = currentOffset + n
+				gd.debug("%s: content length is %d", file.Path, contentLength)
+			}
+			if err = seekableReader.SeekTo(currentOffset); err != nil {
+				return err
+			}
+		}
+
+		end := currentOffset + int64(chunkSize)
+		if contentLength >= 0 && end > contentLength {
+			end = contentLength
+		}
+		gd.debug("%s: uploading chunk %d - %d...", file.Path,
+			currentOffset, end)
+
 		// Only allow the current range of bytes to be uploaded
 		// with this PUT.
 		var body io.Reader = &io.LimitedReader{
@@ -367,15 +502,20 @@ func (gd *GDrive) UploadFileContentsResumable(file *File,
 		req.ContentLength = int64(end - currentOffset)
 		req.Header.Set("Content-Type", contentType)
 		req.Header.Set("Content-Range",
-			fmt.Sprintf("bytes %d-%d/%d", currentOffset, end-1, contentLength))
+			fmt.Sprintf("bytes %d-%d/%s", currentOffset, end-1, rangeTotal(contentLength)))
 		req.Header.Set("User-Agent", "skicka/0.1")
 
 		// Actually (try to) upload the chunk.
+		chunkStart, startTime := currentOffset, time.Now()
 		resp, err := gd.client.Do(req)
+		elapsed := time.Since(startTime)
+		chunkOK := err == nil && resp != nil &&
+			(resp.StatusCode == 308 || resp.StatusCode/100 == 2)
 
 		status, err := gd.handleResumableUploadResponse(resp, err,
 			file.driveFile(), contentType, contentLength, &try, &currentOffset,
 			&sessionURI)
+		sizer.update(currentOffset-chunkStart, elapsed, chunkOK)
 
 		if resp != nil {
 			googleapi.CloseBody(resp)
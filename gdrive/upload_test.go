@@ -0,0 +1,163 @@
+package gdrive
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChunkSizerFixed(t *testing.T) {
+	cs := chunkSizer{size: DefaultUploadChunkSize}
+	cs.update(DefaultUploadChunkSize, time.Millisecond, true)
+	cs.update(0, time.Second, false)
+	if cs.size != DefaultUploadChunkSize {
+		t.Fatalf("Expected non-adaptive chunk size to stay at %d, got %d",
+			DefaultUploadChunkSize, cs.size)
+	}
+}
+
+func TestChunkSizerAdaptive(t *testing.T) {
+	cs := chunkSizer{size: DefaultUploadChunkSize, adaptive: true}
+
+	// Fast chunks should make the chunk size grow, but never by more than
+	// a factor of two at a time and never past the maximum.
+	for i := 0; i < 20; i++ {
+		prev := cs.size
+		cs.update(int64(cs.size), time.Millisecond, true)
+		if cs.size > 2*prev {
+			t.Fatalf("Chunk size grew too quickly: %d -> %d", prev, cs.size)
+		}
+		if cs.size%UploadChunkSizeMultiple != 0 {
+			t.Fatalf("Chunk size %d not a multiple of %d", cs.size,
+				UploadChunkSizeMultiple)
+		}
+	}
+	if cs.size != maxAdaptiveChunkSize {
+		t.Fatalf("Expected chunk size to reach %d, got %d", maxAdaptiveChunkSize,
+			cs.size)
+	}
+
+	// Errors should make it shrink, down to the minimum.
+	for i := 0; i < 20; i++ {
+		cs.update(0, time.Second, false)
+	}
+	if cs.size != UploadChunkSizeMultiple {
+		t.Fatalf("Expected chunk size to shrink to %d, got %d",
+			UploadChunkSizeMultiple, cs.size)
+	}
+
+	// A chunk that takes about targetChunkDuration should leave the size
+	// alone.
+	cs.size = 4 * UploadChunkSizeMultiple
+	cs.update(int64(cs.size), targetChunkDuration, true)
+	if cs.size != 4*UploadChunkSizeMultiple {
+		t.Fatalf("Expected chunk size to stay at %d, got %d",
+			4*UploadChunkSizeMultiple, cs.size)
+	}
+}
+
+// resumableUploadServer is an http.RoundTripper that implements enough of
+// the Drive resumable upload protocol to check the requests sent by
+// UploadFileContentsResumable().
+type resumableUploadServer struct {
+	t           *testing.T
+	contents    []byte
+	totalLength string
+}
+
+func (s *resumableUploadServer) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp := &http.Response{Header: make(http.Header), Request: req,
+		Body: ioutil.NopCloser(bytes.NewReader(nil))}
+
+	if req.URL.Query().Get("uploadType") == "resumable" {
+		if req.Header.Get("X-Upload-Content-Length") != "" {
+			s.t.Fatalf("Unexpected content length header for unknown length upload")
+		}
+		resp.StatusCode = 200
+		resp.Header.Set("Location", "https://upload.example.com/session")
+		return resp, nil
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	var start, end int64
+	var total string
+	cr := req.Header.Get("Content-Range")
+	if _, err := fmt.Sscanf(strings.Replace(cr, "/", " ", 1), "bytes %d-%d %s",
+		&start, &end, &total); err != nil {
+		s.t.Fatalf("%s: malformed Content-Range: %v", cr, err)
+	}
+	if start != int64(len(s.contents)) || end-start+1 != int64(len(body)) {
+		s.t.Fatalf("%s: unexpected range for %d bytes; have %d so far", cr,
+			len(body), len(s.contents))
+	}
+	s.contents = append(s.contents, body...)
+
+	if total != "*" {
+		s.totalLength = total
+		resp.StatusCode = 200
+	} else {
+		resp.StatusCode = 308
+		resp.Header.Set("Range", fmt.Sprintf("bytes=0-%d", end))
+	}
+	return resp, nil
+}
+
+func TestUploadResumableUnknownLength(t *testing.T) {
+	for _, length := range []int{1, UploadChunkSizeMultiple - 1, UploadChunkSizeMultiple,
+		3*UploadChunkSizeMultiple + 17} {
+		server := &resumableUploadServer{t: t}
+		gd := &GDrive{
+			client:          &http.Client{Transport: server},
+			debug:           func(s string, args ...interface{}) {},
+			uploadChunkSize: UploadChunkSizeMultiple,
+		}
+
+		b := getRandomBytes(length)
+		if err := gd.UploadFileContentsResumable(&File{Id: "id"}, bytes.NewReader(b),
+			-1); err != nil {
+			t.Fatalf("%d bytes: upload failed: %v", length, err)
+		}
+		if bytes.Compare(b, server.contents) != 0 {
+			t.Fatalf("%d bytes: uploaded contents don't match", length)
+		}
+		if server.totalLength != fmt.Sprintf("%d", length) {
+			t.Fatalf("%d bytes: total length given as %q", length, server.totalLength)
+		}
+	}
+}
+
+// emptyUploadServer records the PUT requests that are sent to it.
+type emptyUploadServer struct {
+	methods []string
+	lengths []int64
+}
+
+func (s *emptyUploadServer) RoundTrip(req *http.Request) (*http.Response, error) {
+	s.methods = append(s.methods, req.Method)
+	s.lengths = append(s.lengths, req.ContentLength)
+	return &http.Response{StatusCode: 200, Header: make(http.Header),
+		Body: ioutil.NopCloser(strings.NewReader("{}"))}, nil
+}
+
+func TestUploadEmptyContents(t *testing.T) {
+	// Empty contents still have to be sent, so that an existing file
+	// is truncated.
+	server := &emptyUploadServer{}
+	gd := &GDrive{
+		client: &http.Client{Transport: server},
+		debug:  func(s string, args ...interface{}) {},
+	}
+	if err := gd.UploadFileContents(&File{Id: "id"}, bytes.NewReader(nil), 0, 0); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	if len(server.methods) != 1 || server.methods[0] != "PUT" || server.lengths[0] != 0 {
+		t.Fatalf("Expected a single empty PUT, got %v %v", server.methods, server.lengths)
+	}
+}
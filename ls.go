@@ -32,6 +32,9 @@ func getPermissionsAsString(driveFile *gdrive.File) (string, error) {
 	var str string
 	if driveFile.IsFolder() {
 		str = "d"
+	} else if isSymlinkFile(driveFile) {
+		// As on Unix, symlinks don't have permissions of their own.
+		return "lrwxrwxrwx", nil
 	} else {
 		str = "-"
 	}
@@ -157,6 +160,12 @@ func lsFile(f *gdrive.File, recursive, long, longlong bool) {
 		return
 	}
 
+	if isSymlinkFile(f) {
+		if target, err := getSymlinkTarget(f); err == nil {
+			printFilename += " -> " + target
+		}
+	}
+
 	synctime := f.ModTime.Local()
 	permString, _ := getPermissionsAsString(f)
 	if longlong {
@@ -0,0 +1,123 @@
+//
+// manifest.go
+// Copyright(c)2014-2015 Google, Inc.
+//
+// This file is part of skicka.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/google/skicka/gdrive"
+	"os"
+	"sync"
+)
+
+// With -manifest, "upload" and "download" write a line of JSON for each
+// file they consider, describing what was done with it.
+
+// Values for manifestEntry.Action.
+const (
+	manifestCreated      = "created"
+	manifestUpdated      = "updated"
+	manifestMetadataOnly = "metadata-only"
+	manifestSkipped      = "skipped"
+	manifestFailed       = "failed"
+	manifestDeleted      = "deleted"
+)
+
+type manifestEntry struct {
+	LocalPath string `json:"local_path"`
+	DrivePath string `json:"drive_path"`
+	DriveId   string `json:"drive_id,omitempty"`
+	Size      int64  `json:"size"`
+	Md5       string `json:"md5,omitempty"`
+	Action    string `json:"action"`
+	Reason    string `json:"reason,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+var manifest struct {
+	sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+	err error
+}
+
+// openManifest creates the manifest file with the given name; after it's
+// been called, addToManifest writes entries to it.
+func openManifest(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	manifest.f = f
+	manifest.enc = json.NewEncoder(f)
+	return nil
+}
+
+// closeManifest closes the manifest file, if there is one, returning the
+// first error encountered writing it.
+func closeManifest() error {
+	manifest.Lock()
+	defer manifest.Unlock()
+	if manifest.f == nil {
+		return nil
+	}
+	err := manifest.f.Close()
+	if manifest.err != nil {
+		err = manifest.err
+	}
+	manifest.f, manifest.enc = nil, nil
+	return err
+}
+
+// addToManifest writes the given entry to the manifest, if one is being
+// written; if err is non-nil, its message is recorded in the entry.
+func addToManifest(e manifestEntry, err error) {
+	manifest.Lock()
+	defer manifest.Unlock()
+	if manifest.enc == nil {
+		return
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if werr := manifest.enc.Encode(e); werr != nil && manifest.err == nil {
+		manifest.err = werr
+	}
+}
+
+// manifestEntryForFile returns a manifest entry for the given local file
+// and Drive file, either of which may be missing, with the given action
+// and reason.
+func manifestEntryForFile(localPath, drivePath string, f *gdrive.File,
+	action, reason string) manifestEntry {
+	e := manifestEntry{LocalPath: localPath, DrivePath: drivePath,
+		Action: action, Reason: reason}
+	if f != nil {
+		e.DriveId, e.Md5 = f.Id, f.Md5
+		if e.DrivePath == "" {
+			e.DrivePath = f.Path
+		}
+	}
+	if stat, err := os.Stat(localPath); err == nil && !stat.IsDir() {
+		e.Size = stat.Size()
+	} else if f != nil {
+		e.Size = f.FileSize
+	}
+	return e
+}
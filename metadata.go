@@ -0,0 +1,214 @@
+//
+// metadata.go
+// Copyright(c)2014-2015 Google, Inc.
+//
+// This file is part of skicka.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/skicka/gdrive"
+	"os"
+	"strconv"
+)
+
+// Properties used to record file metadata beyond the permissions when
+// "upload -preserve-metadata" is used.
+const (
+	uidProperty         = "Uid"
+	gidProperty         = "Gid"
+	specialBitsProperty = "SpecialBits"
+	xattrsProperty      = "Xattrs"
+)
+
+// Google Drive allows at most 100 properties on a file; limit the number
+// used for extended attributes so that there's room for the others.
+const maxXattrProperties = 64
+
+// Returns the setuid, setgid, and sticky bits of the given mode in their
+// traditional Unix octal representation.
+func specialBits(mode os.FileMode) int64 {
+	var bits int64
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return bits
+}
+
+// The inverse of specialBits.
+func specialBitsToMode(bits int64) os.FileMode {
+	var mode os.FileMode
+	if bits&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if bits&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// getMetadataProperties returns the Drive properties that record the
+// ownership, special mode bits, and extended attributes of the given local
+// file.
+func getMetadataProperties(localPath string, stat os.FileInfo) ([]gdrive.Property, error) {
+	var proplist []gdrive.Property
+	if uid, gid, ok := getFileOwner(stat); ok {
+		proplist = append(proplist,
+			gdrive.Property{Key: uidProperty, Value: strconv.Itoa(uid)},
+			gdrive.Property{Key: gidProperty, Value: strconv.Itoa(gid)})
+	}
+	proplist = append(proplist, gdrive.Property{Key: specialBitsProperty,
+		Value: fmt.Sprintf("%#o", specialBits(stat.Mode()))})
+
+	xattrs, err := getXattrs(localPath)
+	if err != nil {
+		return nil, err
+	}
+	// Attribute values may be arbitrary binary data; encoding/json
+	// base64-encodes them and sorts the map keys, so that the encoding is
+	// deterministic and can be compared against the stored one.
+	enc, err := json.Marshal(xattrs)
+	if err != nil {
+		return nil, err
+	}
+	xprops := makeLongProperty(xattrsProperty, string(enc))
+	if len(xprops) > maxXattrProperties {
+		fmt.Fprintf(os.Stderr, "skicka: %s: extended attributes are too "+
+			"large to store on Google Drive; skipping them.\n", localPath)
+	} else {
+		proplist = append(proplist, xprops...)
+	}
+	return proplist, nil
+}
+
+// updateMetadataProperties updates the properties of the given Drive file
+// that record the local file's ownership, special mode bits, and extended
+// attributes; only the properties that have changed are sent to Drive.
+func updateMetadataProperties(driveFile *gdrive.File, localPath string,
+	stat os.FileInfo) error {
+	proplist, err := getMetadataProperties(localPath, stat)
+	if err != nil {
+		return err
+	}
+
+	var xattrs string
+	for _, prop := range proplist {
+		switch prop.Key {
+		case uidProperty, gidProperty, specialBitsProperty:
+			if _, err := driveFile.GetProperty(prop.Key); err != nil {
+				err = gd.AddProperty(prop.Key, prop.Value, driveFile)
+			} else {
+				err = gd.UpdateProperty(driveFile, prop.Key, prop.Value)
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			// Pieces of the Xattrs property.
+			xattrs += prop.Value
+		}
+	}
+	if xattrs != "" {
+		return updateLongProperty(driveFile, xattrsProperty, xattrs)
+	}
+	return nil
+}
+
+// restoreLocalMetadata applies the ownership, special mode bits, and
+// extended attributes stored in the properties of the given Drive file (if
+// any) to the local file. Changes that the user doesn't have permission to
+// make (e.g., changing a file's owner when not running as root) are
+// silently skipped.
+func restoreLocalMetadata(localPath string, f *gdrive.File) error {
+	stat, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+
+	// Ownership has to be set first, since chown clears the setuid and
+	// setgid bits.
+	uidStr, uidErr := f.GetProperty(uidProperty)
+	gidStr, gidErr := f.GetProperty(gidProperty)
+	if uidErr == nil && gidErr == nil {
+		uid, err := strconv.Atoi(uidStr)
+		if err != nil {
+			return fmt.Errorf("invalid %s property: %v", uidProperty, err)
+		}
+		gid, err := strconv.Atoi(gidStr)
+		if err != nil {
+			return fmt.Errorf("invalid %s property: %v", gidProperty, err)
+		}
+		if luid, lgid, ok := getFileOwner(stat); ok && (luid != uid || lgid != gid) {
+			if err := ignorePermissionError(os.Chown(localPath, uid, gid)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if xattrStr, err := getLongProperty(f, xattrsProperty); err == nil {
+		var xattrs map[string][]byte
+		if err := json.Unmarshal([]byte(xattrStr), &xattrs); err != nil {
+			return fmt.Errorf("invalid %s property: %v", xattrsProperty, err)
+		}
+		local, err := getXattrs(localPath)
+		if err != nil {
+			return err
+		}
+		for name, value := range xattrs {
+			if lv, ok := local[name]; ok && string(lv) == string(value) {
+				continue
+			}
+			if err := ignorePermissionError(setXattr(localPath, name, value)); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+
+	if bitsStr, err := f.GetProperty(specialBitsProperty); err == nil {
+		bits, err := strconv.ParseInt(bitsStr, 8, 16)
+		if err != nil {
+			return fmt.Errorf("invalid %s property: %v", specialBitsProperty, err)
+		}
+		// The callers have already set the permissions, so just add the
+		// special bits to them.
+		if mode := specialBitsToMode(bits); mode != 0 {
+			perm := stat.Mode() & os.ModePerm
+			if err := ignorePermissionError(os.Chmod(localPath, perm|mode)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func ignorePermissionError(err error) error {
+	if err != nil && os.IsPermission(err) {
+		debug.Printf("ignoring error: %v", err)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+//
+// metadata_unix.go
+// Copyright(c)2014-2015 Google, Inc.
+//
+// This file is part of skicka.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+//go:build darwin || freebsd || linux
+// +build darwin freebsd linux
+
+package main
+
+import (
+	"bytes"
+	"golang.org/x/sys/unix"
+	"os"
+	"syscall"
+)
+
+func getFileOwner(stat os.FileInfo) (uid, gid int, ok bool) {
+	st, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
+
+// getXattrs returns the extended attributes of the given file. An empty
+// map is returned if the filesystem doesn't support extended attributes.
+func getXattrs(path string) (map[string][]byte, error) {
+	xattrs := make(map[string][]byte)
+
+	sz, err := unix.Listxattr(path, nil)
+	if err == unix.ENOTSUP {
+		return xattrs, nil
+	} else if err != nil {
+		return nil, &os.PathError{Op: "listxattr", Path: path, Err: err}
+	}
+	names := make([]byte, sz)
+	if sz, err = unix.Listxattr(path, names); err != nil {
+		return nil, &os.PathError{Op: "listxattr", Path: path, Err: err}
+	}
+
+	// The names are returned as a sequence of NUL-terminated strings.
+	for _, name := range bytes.Split(names[:sz], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		sz, err := unix.Getxattr(path, string(name), nil)
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+		}
+		value := make([]byte, sz)
+		if sz, err = unix.Getxattr(path, string(name), value); err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+		}
+		xattrs[string(name)] = value[:sz]
+	}
+	return xattrs, nil
+}
+
+func setXattr(path, name string, value []byte) error {
+	if err := unix.Setxattr(path, name, value, 0); err != nil {
+		return &os.PathError{Op: "setxattr", Path: path, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+//
+// mimetypes.go
+// Copyright(c)2014-2015 Google, Inc.
+//
+// This file is part of skicka.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Encrypted files are given this MIME type on Drive, since their contents
+// are opaque.
+const encryptedMimeType = "application/x-skicka-encrypted"
+
+const defaultMimeType = "application/octet-stream"
+
+// MIME types for common file extensions that Go's mime package doesn't
+// know about on all systems.
+var extensionMimeTypes = map[string]string{
+	".7z":   "application/x-7z-compressed",
+	".bz2":  "application/x-bzip2",
+	".c":    "text/x-c",
+	".cc":   "text/x-c++",
+	".cpp":  "text/x-c++",
+	".csv":  "text/csv",
+	".doc":  "application/msword",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".epub": "application/epub+zip",
+	".go":   "text/x-go",
+	".gz":   "application/gzip",
+	".h":    "text/x-c",
+	".java": "text/x-java",
+	".json": "application/json",
+	".md":   "text/markdown",
+	".mkv":  "video/x-matroska",
+	".mov":  "video/quicktime",
+	".mp3":  "audio/mpeg",
+	".mp4":  "video/mp4",
+	".odp":  "application/vnd.oasis.opendocument.presentation",
+	".ods":  "application/vnd.oasis.opendocument.spreadsheet",
+	".odt":  "application/vnd.oasis.opendocument.text",
+	".ppt":  "application/vnd.ms-powerpoint",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".py":   "text/x-python",
+	".rtf":  "application/rtf",
+	".sh":   "application/x-sh",
+	".svg":  "image/svg+xml",
+	".tar":  "application/x-tar",
+	".tsv":  "text/tab-separated-values",
+	".txt":  "text/plain",
+	".xls":  "application/vnd.ms-excel",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".zip":  "application/zip",
+}
+
+// mimeTypeForName returns the MIME type for a file with the given name,
+// based on its extension, or the empty string if it isn't known.  Types
+// given in the config file take precedence.
+func mimeTypeForName(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext == "" {
+		return ""
+	}
+
+	for _, m := range config.Upload.Mime_type {
+		if e, t, err := parseMimeTypeOverride(m); err == nil && e == ext {
+			return t
+		}
+	}
+	if t, ok := extensionMimeTypes[ext]; ok {
+		return t
+	}
+	if t, _, err := mime.ParseMediaType(mime.TypeByExtension(ext)); err == nil {
+		return t
+	}
+	return ""
+}
+
+// mimeTypeForFile returns the MIME type to give the Drive file for the
+// given local file.  If the type isn't known from the file's extension,
+// it's determined from the start of the file's contents.
+func mimeTypeForFile(path string, encrypt bool) string {
+	if encrypt {
+		// Both the extension and the contents would reveal
+		// information about the file.
+		return encryptedMimeType
+	}
+	if t := mimeTypeForName(path); t != "" {
+		return t
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return defaultMimeType
+	}
+	defer f.Close()
+	header := make([]byte, 512)
+	n, err := io.ReadFull(f, header)
+	if n == 0 || (err != nil && err != io.ErrUnexpectedEOF) {
+		return defaultMimeType
+	}
+	t, _, err := mime.ParseMediaType(http.DetectContentType(header[:n]))
+	if err != nil {
+		return defaultMimeType
+	}
+	return t
+}
+
+// parseMimeTypeOverride parses a [upload]/mime-type value from the config
+// file, which gives a file extension and the MIME type to use for it,
+// separated by whitespace (e.g., ".log text/plain").
+func parseMimeTypeOverride(s string) (string, string, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 || !strings.HasPrefix(fields[0], ".") ||
+		!strings.Contains(fields[1], "/") {
+		return "", "", fmt.Errorf("%q: expected \".extension type/subtype\"", s)
+	}
+	return strings.ToLower(fields[0]), fields[1], nil
+}
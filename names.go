@@ -0,0 +1,215 @@
+//
+// names.go
+// Copyright(c)2014-2015 Google, Inc.
+//
+// This file is part of skicka.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/google/skicka/gdrive"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// Google Drive file names may contain characters that can't be used in
+// local file names (namely, '/'), and may be longer than local file
+// systems allow.  Conversely, local file names may not be valid UTF-8,
+// which Drive requires.  The functions here map between the two so that
+// files round-trip through upload and download:
+//
+// - A '/' in a Drive name is escaped as "%2F" locally.  So that this is
+//   reversible, a '%' in a Drive name that is followed by "2F" or "25" is
+//   itself escaped as "%25".  Other uses of '%' are left as is, so most
+//   names are unchanged.
+// - Drive names that are too long for the local file system (after
+//   escaping) are shortened, with a hash of the full name added so that
+//   distinct names remain distinct.
+// - When uploading, a local name that may have been escaped or shortened
+//   is matched against the names of existing files on Drive.  Otherwise,
+//   local names that are valid UTF-8 are used on Drive unchanged.
+// - Bytes in local names that aren't valid UTF-8 are stored as "%XX" in
+//   the Drive name.
+// - Whenever downloading the Drive file wouldn't give back the local
+//   name, the original local name is stored in the localNameProperty
+//   property so that download can restore it.
+
+// Property that stores the base64-encoded original local name of a file
+// for which the mapping to a Drive name was lossy.
+const localNameProperty = "LocalName"
+
+// Maximum length of a local file name, in bytes.
+const maxLocalNameLength = 255
+
+// escapeDriveName returns the local name for the given Drive file name,
+// not accounting for length limits.
+func escapeDriveName(name string) string {
+	var b []byte
+	for i := 0; i < len(name); i++ {
+		switch {
+		case name[i] == '/':
+			b = append(b, "%2F"...)
+		case name[i] == '%' && (strings.HasPrefix(name[i+1:], "2F") ||
+			strings.HasPrefix(name[i+1:], "25")):
+			b = append(b, "%25"...)
+		default:
+			b = append(b, name[i])
+		}
+	}
+	return string(b)
+}
+
+// unescapeLocalName is the inverse of escapeDriveName.
+func unescapeLocalName(name string) string {
+	var b []byte
+	for i := 0; i < len(name); i++ {
+		switch {
+		case strings.HasPrefix(name[i:], "%2F"):
+			b = append(b, '/')
+			i += 2
+		case strings.HasPrefix(name[i:], "%25"):
+			b = append(b, '%')
+			i += 2
+		default:
+			b = append(b, name[i])
+		}
+	}
+	return string(b)
+}
+
+// shortenLocalName returns a version of the given name that is at most
+// maxLocalNameLength bytes long, preserving the file extension, if there
+// is a reasonable one, and including a hash of the full name.
+func shortenLocalName(name string) string {
+	if len(name) <= maxLocalNameLength {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if len(ext) > 32 {
+		ext = ""
+	}
+	hash := sha1.Sum([]byte(name))
+	suffix := "~" + hex.EncodeToString(hash[:4]) + ext
+
+	prefix := name[:maxLocalNameLength-len(suffix)]
+	// Don't split a multi-byte character.
+	for len(prefix) > 0 && !utf8.ValidString(prefix) {
+		prefix = prefix[:len(prefix)-1]
+	}
+	return prefix + suffix
+}
+
+// mayBeShortened returns true if the given local name may have been
+// created by shortenLocalName.
+func mayBeShortened(name string) bool {
+	return len(name) > maxLocalNameLength-utf8.UTFMax &&
+		strings.Contains(name, "~")
+}
+
+// localNameForDriveFile returns the name to use for the given Drive file
+// on the local system.  Google Docs files are given the extension of the
+// format they're exported to.
+func localNameForDriveFile(f *gdrive.File) string {
+	ext := exportExtension(f)
+	if enc, err := getLongProperty(f, localNameProperty); err == nil {
+		if name, err := base64.StdEncoding.DecodeString(enc); err == nil &&
+			len(name) > 0 && !strings.ContainsRune(string(name), '/') {
+			return string(name) + ext
+		}
+	}
+	return shortenLocalName(escapeDriveName(f.Title) + ext)
+}
+
+// driveNameForLocalName returns the name to use on Drive for the local file
+// at the given path, which is to be stored in the given Drive folder
+// (which may not exist yet).  If the mapping is lossy, the returned
+// properties should be added to the Drive file so that the local name can
+// be restored.
+func driveNameForLocalName(localPath, driveParentPath string) (string, []gdrive.Property) {
+	name := filepath.Base(localPath)
+	if utf8.ValidString(name) && (mayBeShortened(name) || unescapeLocalName(name) != name) {
+		// See if this is the escaped or shortened name of an existing
+		// Drive file; a file with exactly this name takes precedence.
+		if _, err := gd.GetFile(filepath.Join(driveParentPath, name)); err == gdrive.ErrNotExist {
+			files, _ := gd.GetFilesInFolder(driveParentPath)
+			for _, f := range files {
+				if f.Title != name && localNameForDriveFile(f) == name {
+					return f.Title, localNameProps(f.Title, name)
+				}
+			}
+		}
+	}
+	return newDriveNameForLocalName(localPath)
+}
+
+// newDriveNameForLocalName returns the name and properties to use for a
+// new Drive file for the local file at the given path.  Names that are
+// valid UTF-8 are used unchanged, so that no two local files in a
+// directory map to the same Drive name.
+func newDriveNameForLocalName(localPath string) (string, []gdrive.Property) {
+	name := filepath.Base(localPath)
+	driveName := name
+	if !utf8.ValidString(name) {
+		var b []byte
+		for rest := name; len(rest) > 0; {
+			r, n := utf8.DecodeRuneInString(rest)
+			if r == utf8.RuneError && n == 1 {
+				b = append(b, fmt.Sprintf("%%%02X", rest[0])...)
+			} else {
+				b = append(b, rest[:n]...)
+			}
+			rest = rest[n:]
+		}
+		driveName = string(b)
+		// Don't collide with a local file that actually has that name.
+		if _, err := os.Lstat(filepath.Join(filepath.Dir(localPath), driveName)); err == nil {
+			hash := sha1.Sum([]byte(name))
+			driveName += "~" + hex.EncodeToString(hash[:4])
+		}
+	}
+	return driveName, localNameProps(driveName, name)
+}
+
+// localNameProps returns the properties needed for a Drive file with the
+// given name to be downloaded with the given local name, or nil if
+// localNameForDriveFile() already gives that name.
+func localNameProps(driveName, localName string) []gdrive.Property {
+	if shortenLocalName(escapeDriveName(driveName)) == localName {
+		return nil
+	}
+	return makeLongProperty(localNameProperty,
+		base64.StdEncoding.EncodeToString([]byte(localName)))
+}
+
+// updateLocalNameProperty updates the given Drive file's local name
+// property to match the given properties returned by
+// driveNameForLocalName(), removing it if it's no longer needed.
+func updateLocalNameProperty(f *gdrive.File, nameProps []gdrive.Property) error {
+	if len(nameProps) == 0 {
+		return deleteLongProperty(f, localNameProperty)
+	}
+	var value string
+	for _, prop := range nameProps {
+		value += prop.Value
+	}
+	return updateLongProperty(f, localNameProperty, value)
+}
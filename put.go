@@ -0,0 +1,173 @@
+//
+// put.go
+// Copyright(c)2014-2015 Google, Inc.
+//
+// This file is part of skicka.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"fmt"
+	"github.com/google/skicka/gdrive"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+func putUsage() {
+	fmt.Printf("Usage: skicka put [-encrypt] - drive_path\n")
+	fmt.Printf("Run \"skicka help\" for more detailed help text.\n")
+}
+
+// put uploads the contents of stdin to a file on Drive, creating it if
+// necessary.  Since the contents can't be re-read, they're always sent
+// with the resumable upload protocol, which can retry after errors by
+// buffering recently-sent data.
+func put(args []string) int {
+	encrypt := false
+	var argFilenames []string
+	for _, arg := range args {
+		switch {
+		case len(argFilenames) == 0 && arg == "-encrypt":
+			encrypt = true
+		default:
+			argFilenames = append(argFilenames, arg)
+		}
+	}
+	if len(argFilenames) != 2 || argFilenames[0] != "-" {
+		putUsage()
+		return 1
+	}
+	drivePath := filepath.Clean(argFilenames[1])
+	if encrypt {
+		drivePath += encryptionSuffix
+		if key == nil {
+			key = decryptEncryptionKey()
+		}
+	}
+
+	syncStartTime = time.Now()
+	driveFile, iv, err := getFileForPut(drivePath, encrypt)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "skicka: %s: %v\n", drivePath, err)
+		return 1
+	}
+
+	var reader io.Reader = os.Stdin
+	if encrypt {
+		// As with regular uploads, the initialization vector is stored
+		// at the start of the file.
+		reader = io.MultiReader(bytes.NewReader(iv),
+			makeEncrypterReader(key, iv, reader))
+	}
+	countingReader := &byteCountingReader{R: reader}
+
+	err = gd.UploadFileContentsResumable(driveFile, countingReader, -1)
+	if err == nil && countingReader.bytesRead == 0 {
+		// The resumable upload doesn't send anything for empty contents,
+		// which would leave an existing file's contents as they were;
+		// upload an empty body to truncate it instead.
+		for try := 0; ; try++ {
+			err = gd.UploadFileContents(driveFile, bytes.NewReader(nil), 0, try)
+			if _, ok := err.(gdrive.RetryHTTPTransmitError); !ok || try >= 5 {
+				break
+			}
+		}
+	}
+	atomic.AddInt64(&stats.DiskReadBytes, countingReader.bytesRead)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "skicka: %s: %v\n", drivePath, err)
+		return 1
+	}
+	atomic.AddInt64(&stats.DriveFilesUpdated, 1)
+	atomic.AddInt64(&stats.UploadBytes, countingReader.bytesRead)
+
+	// As in syncFileUp(), the modification time is only updated after
+	// the contents have been uploaded successfully.
+	if err := gd.UpdateModificationTime(driveFile, normalizeModTime(time.Now())); err != nil {
+		fmt.Fprintf(os.Stderr, "skicka: %s: %v\n", drivePath, err)
+		return 1
+	}
+
+	printFinalStats()
+	return 0
+}
+
+// getFileForPut returns the Drive file at the given path, creating it if it
+// doesn't already exist; the parent folder must already exist.  If the
+// contents are to be encrypted, the file's initialization vector is
+// returned as well.
+func getFileForPut(drivePath string, encrypt bool) (*gdrive.File, []byte, error) {
+	driveFile, err := gd.GetFile(drivePath)
+	switch err {
+	case nil:
+		if driveFile.IsFolder() {
+			return nil, nil, fmt.Errorf("is a folder")
+		}
+		if !encrypt {
+			return driveFile, nil, nil
+		}
+		if iv, err := getInitializationVector(driveFile); err == nil {
+			return driveFile, iv, nil
+		}
+		// The file doesn't have an IV yet; since its contents are about
+		// to be replaced, it's safe to give it a new one.
+		iv := getRandomBytes(aes.BlockSize)
+		if err := gd.AddProperty("IV", hex.EncodeToString(iv), driveFile); err != nil {
+			return nil, nil, err
+		}
+		return driveFile, iv, nil
+	case gdrive.ErrNotExist:
+		parentFolder, err := gd.GetFile(filepath.Dir(drivePath))
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", filepath.Dir(drivePath), err)
+		}
+		if !parentFolder.IsFolder() {
+			return nil, nil, fmt.Errorf("%s: not a folder", parentFolder.Path)
+		}
+
+		var iv []byte
+		var proplist []gdrive.Property
+		if encrypt {
+			iv = getRandomBytes(aes.BlockSize)
+			proplist = append(proplist, gdrive.Property{Key: "IV",
+				Value: hex.EncodeToString(iv)})
+		}
+		proplist = append(proplist, gdrive.Property{Key: "Permissions",
+			Value: fmt.Sprintf("%#o", 0644)})
+		// As in syncFileUp(), start with the epoch as the modification
+		// time so that a failed upload isn't mistaken for a complete one.
+		// The contents haven't been read yet, so the MIME type can only
+		// come from the extension; otherwise, it's detected from the
+		// contents when they're uploaded.
+		mimeType := encryptedMimeType
+		if !encrypt {
+			mimeType = mimeTypeForName(drivePath)
+		}
+		if mimeType == "" {
+			mimeType = defaultMimeType
+		}
+		driveFile, err = gd.CreateFileWithMimeType(filepath.Base(drivePath),
+			parentFolder, time.Unix(0, 0), proplist, mimeType)
+		return driveFile, iv, err
+	default:
+		return nil, nil, err
+	}
+}
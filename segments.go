@@ -0,0 +1,283 @@
+//
+// segments.go
+// Copyright(c)2014-2015 Google, Inc.
+//
+// This file is part of skicka.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"github.com/cheggaaa/pb"
+	"github.com/google/skicka/gdrive"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Large files are downloaded in segments that are fetched concurrently,
+// each over its own connection, and written to the local file at their
+// offsets.  If the download can be resumed, the offsets of the segments
+// that have been written are saved in a log next to the partial download,
+// so that an interrupted download only fetches the missing segments when
+// it's resumed.
+
+// Files at least this large are downloaded in segments.
+const segmentedDownloadMinSize = 64 * 1024 * 1024
+
+// Size of each segment; it's a multiple of aes.BlockSize, so that the
+// segments of encrypted files start at block boundaries.
+const downloadSegmentSize = 16 * 1024 * 1024
+
+// Suffix added to the name of a partial download for its segment log.
+const segmentLogSuffix = ".segments"
+
+// useSegmentedDownload returns true if the given Drive file should be
+// downloaded to localPath in segments.  Compressed files can only be
+// decompressed from the start, and a partial download of the file is
+// resumed the same way it was started.
+func useSegmentedDownload(f *gdrive.File, localPath string) bool {
+	if nWorkers < 2 || f.IsGoogleAppsFile() || isSymlinkFile(f) ||
+		logicalFileSize(f) < segmentedDownloadMinSize {
+		return false
+	}
+	if compressed, err := isCompressed(f); err != nil || compressed {
+		return false
+	}
+	if _, err := isEncrypted(f); err != nil {
+		return false
+	}
+	if canResumeDownload(f) {
+		partialPath := partialDownloadPath(localPath, f)
+		if _, err := os.Stat(partialPath); err == nil {
+			_, err := os.Stat(segmentLogPath(partialPath))
+			return err == nil
+		}
+	}
+	return true
+}
+
+// segmentLogPath returns the path of the segment log for the partial
+// download at the given path.
+func segmentLogPath(partialPath string) string {
+	return partialPath + segmentLogSuffix
+}
+
+// segmentLog keeps track of the segments of a segmented download that
+// have been written to the local file.
+type segmentLog struct {
+	mutex sync.Mutex
+	// The log file, with the offset of each segment that's been written
+	// on a line of its own; nil if the download can't be resumed.
+	file *os.File
+	done map[int64]bool
+}
+
+func newSegmentLog() *segmentLog {
+	return &segmentLog{done: make(map[int64]bool)}
+}
+
+// openSegmentLog opens the segment log for the partial download at the
+// given path, creating it if needed, and reads the offsets of the
+// segments that were written by earlier downloads.
+func openSegmentLog(partialPath string) (*segmentLog, error) {
+	f, err := os.OpenFile(segmentLogPath(partialPath), os.O_RDWR|os.O_CREATE|os.O_APPEND,
+		0600)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := ioutil.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	log := newSegmentLog()
+	log.file = f
+	for _, line := range strings.Split(string(contents), "\n") {
+		// A line that was only partly written when the previous
+		// download was interrupted is ignored, so its segment is
+		// downloaded again.
+		if start, err := strconv.ParseInt(line, 10, 64); err == nil &&
+			start%downloadSegmentSize == 0 {
+			log.done[start] = true
+		}
+	}
+	return log, nil
+}
+
+// isDone returns true if the segment starting at the given offset has
+// been written.
+func (log *segmentLog) isDone(start int64) bool {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	return log.done[start]
+}
+
+// markDone records that the segment starting at the given offset has been
+// written to the given local file.
+func (log *segmentLog) markDone(file *os.File, start int64) error {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	log.done[start] = true
+	if log.file == nil {
+		return nil
+	}
+	// Make sure that the segment's contents are on disk before it's
+	// logged as written.
+	if config.Download.Fsync {
+		if err := file.Sync(); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(log.file, "%d\n", start)
+	return err
+}
+
+// reset forgets all of the segments that have been written.
+func (log *segmentLog) reset() error {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	log.done = make(map[int64]bool)
+	if log.file == nil {
+		return nil
+	}
+	return log.file.Truncate(0)
+}
+
+func (log *segmentLog) close() error {
+	if log.file == nil {
+		return nil
+	}
+	return log.file.Close()
+}
+
+// downloadDriveFileSegments downloads the contents of the given Drive file
+// to the given local file, fetching up to nWorkers segments at once.
+// Segments that the given log says have already been written are skipped.
+func downloadDriveFileSegments(file *os.File, driveFile *gdrive.File, log *segmentLog,
+	progressBar *pb.ProgressBar) error {
+	// Allocate the whole file up front so that segments can be written
+	// wherever they go.
+	size := logicalFileSize(driveFile)
+	if err := file.Truncate(size); err != nil {
+		return err
+	}
+
+	var firstErr error
+	var errMutex sync.Mutex
+	failed := func() bool {
+		errMutex.Lock()
+		defer errMutex.Unlock()
+		return firstErr != nil
+	}
+
+	segmentChan := make(chan int64)
+	var wg sync.WaitGroup
+	for i := 0; i < nWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for start := range segmentChan {
+				length := size - start
+				if length > downloadSegmentSize {
+					length = downloadSegmentSize
+				}
+				err := downloadSegment(file, driveFile, start, length, progressBar)
+				if err == nil {
+					err = log.markDone(file, start)
+				}
+				if err != nil {
+					errMutex.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					errMutex.Unlock()
+				}
+			}
+		}()
+	}
+
+	// Stop handing out segments once one has failed, since the download
+	// as a whole has.
+	for start := int64(0); start < size && !failed(); start += downloadSegmentSize {
+		if log.isDone(start) {
+			if progressBar != nil {
+				length := size - start
+				if length > downloadSegmentSize {
+					length = downloadSegmentSize
+				}
+				progressBar.Add64(length)
+			}
+			continue
+		}
+		segmentChan <- start
+	}
+	close(segmentChan)
+	wg.Wait()
+
+	return firstErr
+}
+
+// downloadSegment downloads the given range of the given Drive file's
+// contents and writes it at the same offset in the local file.
+func downloadSegment(file *os.File, driveFile *gdrive.File, start, length int64,
+	progressBar *pb.ProgressBar) error {
+	acquireDownloadConnection()
+	defer releaseDownloadConnection()
+
+	debug.Printf("%s: downloading segment at %d (%d bytes)", driveFile.Path, start,
+		length)
+	contentsReader, err := getDecryptedContentsReader(driveFile, start, length)
+	if err != nil {
+		return err
+	}
+	defer contentsReader.Close()
+
+	var writer io.Writer = &offsetWriter{f: file, offset: start}
+	if progressBar != nil {
+		writer = io.MultiWriter(writer, progressBar)
+	}
+	bcr := &byteCountingReader{R: io.LimitReader(contentsReader, length)}
+	_, err = io.Copy(writer, bcr)
+
+	atomic.AddInt64(&stats.DownloadBytes, bcr.bytesRead)
+	atomic.AddInt64(&stats.DiskWriteBytes, bcr.bytesRead)
+	if err == nil && bcr.bytesRead != length {
+		err = fmt.Errorf("segment at offset %d: got %d bytes, expected %d", start,
+			bcr.bytesRead, length)
+	}
+	if err != nil && progressBar != nil {
+		// The segment will have to be downloaded again.
+		progressBar.Add64(-bcr.bytesRead)
+	}
+	return err
+}
+
+// offsetWriter writes to a file sequentially starting at the given offset.
+type offsetWriter struct {
+	f      *os.File
+	offset int64
+}
+
+func (ow *offsetWriter) Write(p []byte) (int, error) {
+	n, err := ow.f.WriteAt(p, ow.offset)
+	ow.offset += int64(n)
+	return n, err
+}
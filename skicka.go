@@ -50,13 +50,23 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
 const timeFormat = "2006-01-02T15:04:05.000000000Z07:00"
 const encryptionSuffix = ".aes256"
-const resumableUploadMinSize = 64 * 1024 * 1024
 const passphraseEnvironmentVariable = "SKICKA_PASSPHRASE"
 
+// Symlinks that are preserved by "upload -preserve-symlinks" are stored as
+// empty Drive files with this MIME type; the link target is stored in the
+// symlinkTargetProperty property.
+const symlinkMimeType = "inode/symlink"
+const symlinkTargetProperty = "SymlinkTarget"
+
+// Google Drive limits the combined length of a property's key and value
+// to 124 bytes of UTF-8.
+const maxPropertyLength = 124
+
 ///////////////////////////////////////////////////////////////////////////
 // Global Variables
 
@@ -91,9 +101,29 @@ var (
 		Upload struct {
 			Ignored_Regexp         []string
 			Bytes_per_second_limit int
+			// Files at least this large are uploaded with the resumable
+			// upload protocol, in chunks of Chunk_size bytes.
+			Resumable_threshold int
+			Chunk_size          int
+			Adaptive_chunk_size bool
+			// Each gives a file extension and the MIME type to use for
+			// files with it; see mimetypes.go.
+			Mime_type []string
+			// Default size and age filters; see filter.go.
+			Min_size   string
+			Max_size   string
+			Newer_than string
+			Older_than string
 		}
 		Download struct {
 			Bytes_per_second_limit int
+			Min_size               string
+			Max_size               string
+			Newer_than             string
+			Older_than             string
+			// Whether downloaded files should be flushed to disk before
+			// they replace the local files.
+			Fsync bool
 		}
 	}
 
@@ -106,6 +136,7 @@ var (
 		UploadBytes       int64
 		DownloadBytes     int64
 		LocalFilesUpdated int64
+		LocalFilesDeleted int64
 		DriveFilesUpdated int64
 	}
 
@@ -114,6 +145,10 @@ var (
 	// Drive APIs take a while.  (However, we don't want too have too many
 	// workers; this would both lead to lots of 403 rate limit errors...)
 	nWorkers int
+
+	// Files at least this large are uploaded using the resumable upload
+	// protocol (and one at a time). May be overridden in the config file.
+	resumableUploadMinSize int64 = 64 * 1024 * 1024
 )
 
 ///////////////////////////////////////////////////////////////////////////
@@ -271,6 +306,9 @@ func printFinalStats() {
 		fmtDuration(syncStartTime.Sub(startTime)), fmtDuration(syncTime))
 	message("Updated %d Drive files, %d local files\n",
 		stats.DriveFilesUpdated, stats.LocalFilesUpdated)
+	if stats.LocalFilesDeleted > 0 {
+		message("Deleted %d local files\n", stats.LocalFilesDeleted)
+	}
 	message("%s read from disk, %s written to disk\n",
 		fmtbytes(stats.DiskReadBytes, false),
 		fmtbytes(stats.DiskWriteBytes, false))
@@ -289,7 +327,7 @@ func printFinalStats() {
 // string. If encryption is enabled, use the encrypted file contents when
 // computing the hash.
 func localFileMD5Contents(path string, encrypt bool, iv []byte) (string, error) {
-	contentsReader, _, err := getFileContentsReaderForUpload(path, encrypt, iv)
+	contentsReader, _, err := getFileContentsReaderForUpload(path, false, encrypt, iv, nil)
 	if contentsReader != nil {
 		defer contentsReader.Close()
 	}
@@ -308,40 +346,58 @@ func localFileMD5Contents(path string, encrypt bool, iv []byte) (string, error)
 }
 
 // Returns an io.ReadCloser for given file, such that the bytes read are
-// ready for upload: specifically, if encryption is enabled, the contents
-// are encrypted with the given key and the initialization vector is
-// prepended to the returned bytes. Otherwise, the contents of the file are
-// returned directly.
-func getFileContentsReaderForUpload(path string, encrypt bool,
-	iv []byte) (io.ReadCloser, int64, error) {
+// ready for upload: specifically, if compression is enabled, the contents
+// are compressed, and if encryption is enabled, the (possibly compressed)
+// contents are encrypted with the given key and the initialization vector
+// is prepended to the returned bytes. Otherwise, the contents of the file
+// are returned directly.  The length of compressed contents isn't known in
+// advance, so -1 is returned for it.  If uncompressed isn't nil, the
+// file's contents are also written to it as they're read.
+func getFileContentsReaderForUpload(path string, compress, encrypt bool,
+	iv []byte, uncompressed io.Writer) (io.ReadCloser, int64, error) {
 	f, err := os.Open(path)
 	if err != nil {
-		return f, 0, err
+		return nil, 0, err
 	}
 
 	stat, err := os.Stat(path)
 	if err != nil {
+		f.Close()
 		return nil, 0, err
 	}
 	fileSize := stat.Size()
 
+	var r io.Reader = f
+	if uncompressed != nil {
+		r = io.TeeReader(r, uncompressed)
+	}
+	if compress {
+		r = makeCompressingReader(r)
+		fileSize = -1
+	}
+
 	if encrypt {
 		if key == nil {
 			key = decryptEncryptionKey()
 		}
 
-		r := makeEncrypterReader(key, iv, f)
+		r = makeEncrypterReader(key, iv, r)
 
 		// Prepend the initialization vector to the returned bytes.
 		r = io.MultiReader(bytes.NewReader(iv[:aes.BlockSize]), r)
+		if fileSize >= 0 {
+			fileSize += aes.BlockSize
+		}
+	}
 
-		readCloser := struct {
-			io.Reader
-			io.Closer
-		}{r, f}
-		return readCloser, fileSize + aes.BlockSize, nil
+	if !compress && !encrypt && uncompressed == nil {
+		return f, fileSize, nil
 	}
-	return f, fileSize, nil
+	readCloser := struct {
+		io.Reader
+		io.Closer
+	}{r, f}
+	return readCloser, fileSize, nil
 }
 
 ///////////////////////////////////////////////////////////////////////////
@@ -510,6 +566,103 @@ func getPermissions(driveFile *gdrive.File) (os.FileMode, error) {
 	return os.FileMode(perm), err
 }
 
+// isSymlinkFile returns true if the given Drive file represents a symlink
+// that was stored with "upload -preserve-symlinks".
+func isSymlinkFile(driveFile *gdrive.File) bool {
+	return driveFile.MimeType == symlinkMimeType
+}
+
+func getSymlinkTarget(driveFile *gdrive.File) (string, error) {
+	return getLongProperty(driveFile, symlinkTargetProperty)
+}
+
+// Returns the name of the i'th property used to store a value with the
+// given key by makeLongProperty.
+func longPropertyKey(key string, i int) string {
+	if i == 0 {
+		return key
+	}
+	return fmt.Sprintf("%s.%d", key, i)
+}
+
+// makeLongProperty returns properties that together store the given
+// value. Values that don't fit in a single property are split across
+// properties named key, key.1, key.2, and so forth.
+func makeLongProperty(key, value string) []gdrive.Property {
+	var props []gdrive.Property
+	for {
+		k := longPropertyKey(key, len(props))
+		n := 0
+		// Split at a character boundary so that each piece is valid UTF-8.
+		for _, r := range value {
+			if len(k)+n+utf8.RuneLen(r) > maxPropertyLength {
+				break
+			}
+			n += utf8.RuneLen(r)
+		}
+		props = append(props, gdrive.Property{Key: k, Value: value[:n]})
+		value = value[n:]
+		if value == "" {
+			return props
+		}
+	}
+}
+
+// getLongProperty returns the value stored by makeLongProperty with the
+// given key.
+func getLongProperty(driveFile *gdrive.File, key string) (string, error) {
+	value, err := driveFile.GetProperty(key)
+	if err != nil {
+		return "", err
+	}
+	for i := 1; ; i++ {
+		v, err := driveFile.GetProperty(longPropertyKey(key, i))
+		if err != nil {
+			return value, nil
+		}
+		value += v
+	}
+}
+
+// updateLongProperty updates the value stored in the properties of the
+// given file by makeLongProperty, removing any properties with pieces of
+// the old value that are no longer needed.
+func updateLongProperty(driveFile *gdrive.File, key, value string) error {
+	props := makeLongProperty(key, value)
+	for i := 0; ; i++ {
+		k := longPropertyKey(key, i)
+		_, err := driveFile.GetProperty(k)
+		exists := err == nil
+		switch {
+		case i < len(props) && exists:
+			err = gd.UpdateProperty(driveFile, k, props[i].Value)
+		case i < len(props):
+			err = gd.AddProperty(k, props[i].Value, driveFile)
+		case exists:
+			err = gd.DeleteProperty(driveFile, k)
+		default:
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// deleteLongProperty removes the properties that store the value set by
+// makeLongProperty with the given key, if present.
+func deleteLongProperty(driveFile *gdrive.File, key string) error {
+	for i := 0; ; i++ {
+		k := longPropertyKey(key, i)
+		if _, err := driveFile.GetProperty(k); err != nil {
+			return nil
+		}
+		if err := gd.DeleteProperty(driveFile, k); err != nil {
+			return err
+		}
+	}
+}
+
 ///////////////////////////////////////////////////////////////////////////
 // Error handling
 
@@ -744,6 +897,43 @@ func createConfigFile(filename string) {
 	; To limit upload bandwidth, you can set the maximum (average)
 	; bytes per second that will be used for uploads
 	;bytes-per-second-limit=524288  ; 512kB
+
+	;
+	; Files at least resumable-threshold bytes large are uploaded using
+	; Google Drive's resumable upload protocol, which sends them in chunks
+	; of chunk-size bytes. The chunk size must be a multiple of 262144
+	; (256kB); larger chunks may give better throughput on fast
+	; connections. If adaptive-chunk-size is set, the chunk size is
+	; adjusted automatically during uploads, starting from chunk-size.
+	;resumable-threshold=67108864  ; 64MB
+	;chunk-size=1048576  ; 1MB
+	;adaptive-chunk-size=true
+
+	;
+	; Uploaded files are given MIME types based on their extensions. Use
+	; one mime-type line for each extension whose type you want to
+	; override.
+	;mime-type=.log text/plain
+	;mime-type=.mdx text/markdown
+
+	;
+	; Files can be skipped based on their sizes and modification times;
+	; sizes may be given with k, m, or g suffixes, and times either as a
+	; duration before the current time (e.g., 36h or 7d) or a date. The
+	; same settings may also be given in the [download] section.
+	;max-size=1g
+	;min-size=1k
+	;newer-than=30d
+	;older-than=2015-06-01
+[download]
+	; To limit download bandwidth, you can set the maximum (average)
+	; bytes per second that will be used for downloads
+	;bytes-per-second-limit=524288  ; 512kB
+	;
+	; Downloaded files are written to temporary files that replace the
+	; local files once they're complete; set fsync to flush them to disk
+	; first, so that a crash can't leave an incomplete file in place.
+	;fsync=true
 `
 	// Don't overwrite an already-existing configuration file.
 	if _, err := os.Stat(filename); os.IsNotExist(err) {
@@ -793,6 +983,34 @@ func checkConfigValidity() {
 	nerrs += checkEncryptionConfig(config.Encryption.Encrypted_key_iv,
 		"encrypted-key-iv", 16)
 
+	if config.Upload.Chunk_size < 0 ||
+		config.Upload.Chunk_size%gdrive.UploadChunkSizeMultiple != 0 {
+		fmt.Fprintf(os.Stderr, "skicka: invalid [upload]/chunk-size value %d "+
+			"(must be a multiple of %d).\n", config.Upload.Chunk_size,
+			gdrive.UploadChunkSizeMultiple)
+		nerrs++
+	}
+	if config.Upload.Resumable_threshold < 0 {
+		fmt.Fprintf(os.Stderr, "skicka: invalid [upload]/resumable-threshold "+
+			"value %d.\n", config.Upload.Resumable_threshold)
+		nerrs++
+	}
+	if _, err := uploadFilterFromConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "skicka: invalid [upload] filter: %v.\n", err)
+		nerrs++
+	}
+	if _, err := downloadFilterFromConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "skicka: invalid [download] filter: %v.\n", err)
+		nerrs++
+	}
+	for _, m := range config.Upload.Mime_type {
+		if _, _, err := parseMimeTypeOverride(m); err != nil {
+			fmt.Fprintf(os.Stderr, "skicka: invalid [upload]/mime-type "+
+				"value %v.\n", err)
+			nerrs++
+		}
+	}
+
 	if nerrs > 0 {
 		os.Exit(1)
 	}
@@ -833,13 +1051,33 @@ Commands and their options are:
              local file already exists and has the same contents as the its
              Google Drive file, the download is skipped.
              Arguments: [-ignore-times] [-download-google-apps-files]
-                        drive_path local_path
+                        [-export-format [type=]format[,...]]
+                        [-keep-both | -force] [-delete] drive_path local_path
+             or: [options] -tar <file> drive_path
+             With -tar, the files are written to a tar archive at the given
+             path (or to the standard output, for "-") rather than to a
+             local directory, in order of their paths, and decrypted and
+             decompressed as they would be when downloaded.
+             With -download-google-apps-files, Google Docs files are
+             exported and the format's extension is added to their local
+             names.  -export-format chooses the formats: "document" can
+             be docx (the default), odt, pdf, txt, or md; "spreadsheet"
+             xlsx (the default), ods, csv, or pdf; "presentation" pptx
+             (the default) or pdf; and "drawing" svg (the default) or png.
+             A format given without a type applies to all of the types
+             that support it, e.g., "-export-format pdf".
+             If -delete is given, local files and directories under
+             local_path that aren't in the Drive folder are removed
+             (including copies kept by -keep-both), so that it mirrors
+             the folder; it's refused if the folder is empty on Drive.
 
   df         Prints the total space used and amount of available space on
              Google Drive.
 
   du         Print the space used by the Google Drive folder and its children.
-             Arguments: [drive_path ...]
+             Arguments: [-logical] [drive_path ...]
+             With -logical, the total size of the corresponding local files
+             is also printed; it differs for encrypted and compressed files.
 
   fsck       [EXPERIMENTAL/NEW] Use at your own risk.
              Perform a number of consistency checks on files stored in Google
@@ -869,6 +1107,12 @@ Commands and their options are:
              where intermediate directories in the path are created if -p is
              specified.
 
+  put        Upload the contents of the standard input to the given Google
+             Drive file, creating it if necessary.  The contents are
+             encrypted if -encrypt is given, in which case ".aes256" is
+             appended to the file name, as with "upload".
+             Arguments: [-encrypt] - drive_path
+
   rm	     Remove a file or directory at the given Google Drive path.
              Arguments: [-r, -s] drive_path ...,
              where files and directories are recursively removed if -r is
@@ -880,18 +1124,68 @@ Commands and their options are:
   upload     Uploads all files in the local directory and its children to the
              given Google Drive path. Skips files that have already been
              uploaded.
-             Arguments: [-ignore-times] [-encrypt] [-follow-symlinks <maxdepth>]
+             Arguments: [-ignore-times] [-encrypt]
+                        [-follow-symlinks <maxdepth> | -preserve-symlinks]
+                        [-preserve-metadata] [-detect-moves] [-copy-existing]
+                        [-keep-both | -force] [-convert] [-compress]
                         local_path drive_path
+             Symbolic links aren't uploaded unless -follow-symlinks is given,
+             in which case they are followed up to the given depth, or
+             -preserve-symlinks is given, in which case they're stored on
+             Drive as links and recreated by "download".
+             If -preserve-metadata is given, file ownership, setuid,
+             setgid and sticky bits, and extended attributes are also
+             stored; "download" restores them where it has permission to.
+             If -detect-moves is given, files that were moved or renamed
+             locally are moved on Drive, rather than being uploaded again.
+             If -copy-existing is given, new files whose contents are already
+             stored elsewhere on Drive are copied there rather than uploaded.
+             If -convert is given, new office documents and CSV files are
+             converted to Google Docs, Sheets, or Slides; they're converted
+             again whenever the local file changes.
+             If -compress is given, new files are compressed with gzip
+             before they're uploaded (and encrypted, with -encrypt);
+             "download" and "cat" decompress them.
 
 Options valid for both "upload" and "download":
   -dry-run         Don't actually upload or download, but print the paths of
                    all files that would be transferred.
+  -duplicates=skip|newest|largest|all
+                   What to do with multiple files with the same name in a
+                   Drive folder: skip them, reporting an error (the
+                   default), use the most recently modified one, or use the
+                   largest one.  With "all", which is only valid for
+                   download, all of them are downloaded, and all but the
+                   newest have "~" and the start of their file id added
+                   to their local names.  Duplicate folders are merged.
   -ignore-times    Normally, skicka assumes that if the timestamp of a local
                    file matches the timestamp of the file on Drive and the
                    files have the same size, then it isn't necessary to
                    confirm that the file contents match. The -ignore-times
                    flag can be used to force checking file contents in this
                    case.
+  -manifest <file> Write a line of JSON to the given file for each file that's
+                   considered, giving its local and Drive paths, Drive file
+                   id, size, MD5 checksum, the action taken ("created",
+                   "updated", "metadata-only", "skipped", "failed", or, for
+                   download -delete, "deleted"), and the reason or error,
+                   if any.  Not written with -dry-run.
+  -force           Transfer files that have been modified both locally and
+                   on Drive since they were last synced, overwriting the
+                   other version.  By default, such conflicts are reported
+                   and the files are skipped.
+  -keep-both       For conflicting files, keep both versions: the version
+                   that would be overwritten is kept with ".conflict-<time>"
+                   added to its name.
+  -min-size <size>, -max-size <size>
+                   Skip files smaller or larger than the given size, which
+                   may have a k, m, g, or t suffix (e.g., "100k" or "2g").
+  -newer-than <time>, -older-than <time>
+                   Skip files not modified after (or modified after) the
+                   given time, which is either a duration before now (e.g.,
+                   "36h" or "7d") or a date (e.g., "2015-06-01").  Defaults
+                   for these filters may be given in the [upload] and
+                   [download] sections of the config file.
 
 General options valid for all commands:
   -config <filename>     General skicka configuration file. Default: ~/.skicka.config.
@@ -903,6 +1197,10 @@ General options valid for all commands:
   -no-browser-auth       Disables attempting to open the authorization URL in a web
                          browser when initially authorizing skicka to access Google Drive.
   -quiet                 Suppress non-error messages.
+  -sync-state-file <filename>
+                         File to record the state of files when they were last
+                         uploaded or downloaded, for detecting conflicts.
+                         Default: ~/.skicka.syncstate
   -tokencache <filename> OAuth2 token cache file. Default: ~/.skicka.tokencache.json.
   -verbose               Enable verbose output.
 `)
@@ -921,6 +1219,7 @@ Supported commands are:
   init      Create an initial skicka configuration file
   ls        List the contents of a folder on Google Drive
   mkdir     Create a new folder or folder hierarchy on Drive
+  put       Upload the contents of stdin to a file on Drive
   rm        Remove a file or folder on Google Drive
   upload    Upload a local file or directory hierarchy to Drive
 
@@ -950,6 +1249,9 @@ func main() {
 	metadataCacheFilename := flag.String("metadata-cache-file",
 		filepath.Join(home, "/.skicka.metadata.cache"),
 		"Filename for local cache of Google Drive file metadata")
+	syncStateFilename := flag.String("sync-state-file",
+		filepath.Join(home, ".skicka.syncstate"),
+		"Filename for local record of the state of synced files")
 	nw := flag.Int("num-threads", 4, "Number of threads to use for uploads/downloads")
 	vb := flag.Bool("verbose", false, "Enable verbose output")
 	dbg := flag.Bool("debug", false, "Enable debugging output")
@@ -1002,8 +1304,8 @@ func main() {
 	// a lot of time updating the cache if we were just going to print the
 	// usage message.
 	if cmd != "cat" && cmd != "download" && cmd != "df" && cmd != "du" &&
-		cmd != "fsck" && cmd != "ls" && cmd != "mkdir" && cmd != "rm" &&
-		cmd != "upload" {
+		cmd != "fsck" && cmd != "ls" && cmd != "mkdir" && cmd != "put" &&
+		cmd != "rm" && cmd != "upload" {
 		shortUsage()
 		os.Exit(1)
 	}
@@ -1050,6 +1352,16 @@ func main() {
 			"client: %v", err))
 	}
 
+	if config.Upload.Resumable_threshold > 0 {
+		resumableUploadMinSize = int64(config.Upload.Resumable_threshold)
+	}
+	chunkSize := config.Upload.Chunk_size
+	if chunkSize == 0 {
+		chunkSize = gdrive.DefaultUploadChunkSize
+	}
+	err = gd.SetUploadChunkSize(chunkSize, config.Upload.Adaptive_chunk_size)
+	checkFatalError(err, "")
+
 	args := flag.Args()[1:]
 
 	errs := 0
@@ -1057,7 +1369,9 @@ func main() {
 	case "cat":
 		errs = cat(args)
 	case "download":
+		checkFatalError(loadSyncState(*syncStateFilename), "")
 		errs = download(args)
+		checkFatalError(saveSyncState(*syncStateFilename), "")
 	case "df":
 		errs = df(args)
 	case "du":
@@ -1068,11 +1382,16 @@ func main() {
 		errs = ls(args)
 	case "mkdir":
 		errs = mkdir(args)
+	case "put":
+		errs = put(args)
+		gd.UpdateMetadataCache(*metadataCacheFilename)
 	case "rm":
 		errs = rm(args)
 	case "upload":
+		checkFatalError(loadSyncState(*syncStateFilename), "")
 		errs = upload(args)
 		gd.UpdateMetadataCache(*metadataCacheFilename)
+		checkFatalError(saveSyncState(*syncStateFilename), "")
 	default:
 		errs = 1
 	}
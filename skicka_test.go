@@ -1,10 +1,24 @@
 package main
 
 import (
+	"archive/tar"
 	"bytes"
+	"crypto/aes"
+	"crypto/md5"
+	"errors"
+	"fmt"
 	"github.com/cheggaaa/pb"
+	"github.com/google/skicka/gdrive"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unicode/utf8"
 )
 
 type DevNullWriter struct {
@@ -239,3 +253,1238 @@ func expectErrorWithMessage(t *testing.T, err error, msg string) {
 	}
 }
 */
+
+func TestLongProperty(t *testing.T) {
+	for _, value := range []string{"", "short", strings.Repeat("x", 500),
+		strings.Repeat("é世", 200)} {
+		props := makeLongProperty("SymlinkTarget", value)
+		for _, p := range props {
+			if len(p.Key)+len(p.Value) > maxPropertyLength {
+				t.Fatalf("Property %s too long: %d bytes", p.Key,
+					len(p.Key)+len(p.Value))
+			}
+			if !utf8.ValidString(p.Value) {
+				t.Fatalf("Property %s isn't valid UTF-8", p.Key)
+			}
+		}
+
+		f := &gdrive.File{Properties: props}
+		v, err := getLongProperty(f, "SymlinkTarget")
+		if err != nil {
+			t.Fatalf("getLongProperty: %v", err)
+		}
+		if v != value {
+			t.Fatalf("Expected %q, got %q", value, v)
+		}
+	}
+}
+
+func TestSpecialBits(t *testing.T) {
+	for _, bits := range []int64{0, 01000, 02000, 04000, 07000} {
+		mode := specialBitsToMode(bits) | 0755
+		if got := specialBits(mode); got != bits {
+			t.Fatalf("Expected special bits %#o for mode %v, got %#o", bits, mode, got)
+		}
+	}
+}
+
+func TestDriveNameEscaping(t *testing.T) {
+	for _, name := range []string{"plain.txt", "100%.txt", "a/b", "/", "%2F", "%25",
+		"%2%2F", "%%2F/", "a%252Fb", "%"} {
+		local := escapeDriveName(name)
+		if strings.ContainsRune(local, '/') {
+			t.Fatalf("%q: escaped name %q contains a slash", name, local)
+		}
+		if back := unescapeLocalName(local); back != name {
+			t.Fatalf("%q: escaped to %q, which unescaped to %q", name, local, back)
+		}
+	}
+	if escapeDriveName("100%.txt") != "100%.txt" {
+		t.Fatalf("Unnecessary escaping of '%%'")
+	}
+}
+
+func TestShortenLocalName(t *testing.T) {
+	long := strings.Repeat("é", 200) + ".txt"
+	short := shortenLocalName(long)
+	if len(short) > maxLocalNameLength || !utf8.ValidString(short) ||
+		!strings.HasSuffix(short, ".txt") || !mayBeShortened(short) {
+		t.Fatalf("Bad shortened name %q", short)
+	}
+	if shortenLocalName(long+"x") == short {
+		t.Fatalf("Different long names shortened to the same name")
+	}
+	if shortenLocalName("short.txt") != "short.txt" {
+		t.Fatalf("Short name was changed")
+	}
+}
+
+func TestInvalidUTF8LocalName(t *testing.T) {
+	name := "caf\xe9.txt"
+	driveName, props := newDriveNameForLocalName(name)
+	if !utf8.ValidString(driveName) {
+		t.Fatalf("Drive name %q isn't valid UTF-8", driveName)
+	}
+	f := &gdrive.File{Title: driveName, Properties: props}
+	if local := localNameForDriveFile(f); local != name {
+		t.Fatalf("Expected local name %q, got %q", name, local)
+	}
+
+	// The escaped name mustn't collide with a local file that has it.
+	dir, err := ioutil.TempDir("", "skicka-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, driveName), nil, 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if other, _ := newDriveNameForLocalName(filepath.Join(dir, name)); other == driveName {
+		t.Fatalf("%q and %q both map to Drive name %q", name, driveName, other)
+	}
+}
+
+func TestLocalNameRoundTrip(t *testing.T) {
+	driveNames := make(map[string]string)
+	for _, name := range []string{"plain.txt", "100%.txt", "100%25.txt", "100%2525.txt",
+		"a%2Fb", "%2F", "%25", "%", strings.Repeat("x", 248) + "%25.txt", "caf\xe9.txt"} {
+		driveName, props := newDriveNameForLocalName(name)
+		if other, ok := driveNames[driveName]; ok {
+			t.Fatalf("%q and %q both map to Drive name %q", name, other, driveName)
+		}
+		driveNames[driveName] = name
+		if !utf8.ValidString(driveName) {
+			t.Fatalf("%q: Drive name %q isn't valid UTF-8", name, driveName)
+		}
+		f := &gdrive.File{Title: driveName, Properties: props}
+		if local := localNameForDriveFile(f); local != name {
+			t.Fatalf("%q: uploaded as %q, which downloads as %q", name, driveName, local)
+		}
+	}
+	// Existing backups of names like these were stored unchanged.
+	if driveName, _ := newDriveNameForLocalName("a%2Fb"); driveName != "a%2Fb" {
+		t.Fatalf("Local name \"a%%2Fb\" mapped to Drive name %q", driveName)
+	}
+}
+
+func TestConflictName(t *testing.T) {
+	tm := time.Date(2015, 6, 1, 12, 30, 0, 0, time.UTC)
+	for _, c := range []struct{ name, expected string }{
+		{"foo.txt", "foo.conflict-20150601-123000.txt"},
+		{"foo", "foo.conflict-20150601-123000"},
+		{"foo.txt.aes256", "foo.conflict-20150601-123000.txt.aes256"},
+	} {
+		if n := conflictName(c.name, tm); n != c.expected {
+			t.Fatalf("conflictName(%q): expected %q, got %q", c.name, c.expected, n)
+		}
+	}
+}
+
+func TestSyncConflict(t *testing.T) {
+	tmp, err := ioutil.TempFile("", "skicka")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	synced := time.Date(2015, 6, 1, 12, 30, 0, 0, time.UTC)
+	later := synced.Add(time.Hour)
+	f := &gdrive.File{Id: "id", Md5: "md5", ModTime: synced}
+
+	check := func(localTime time.Time, expected bool) {
+		if err := os.Chtimes(tmp.Name(), localTime, localTime); err != nil {
+			t.Fatalf("%v", err)
+		}
+		stat, err := os.Stat(tmp.Name())
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if c := isSyncConflict(tmp.Name(), stat, f); c != expected {
+			t.Fatalf("Expected conflict %v for local time %v, Drive file %+v",
+				expected, localTime, *f)
+		}
+	}
+
+	// Never synced.
+	check(later, false)
+
+	recordSync(tmp.Name(), f, f.Md5, synced)
+	check(synced, false)
+	// Only the local file changed.
+	check(later, false)
+	// Both changed.
+	f.Md5 = "newmd5"
+	check(later, true)
+	// Only the Drive file changed.
+	check(synced, false)
+
+	// The local file changed and was uploaded, but the upload was given
+	// up on (or the Drive file's modification time couldn't be set), so
+	// the Drive file has the new contents but not the new time.
+	f.Md5 = "md5"
+	recordSync(tmp.Name(), f, f.Md5, synced)
+	f.Md5 = "uploadedmd5"
+	recordUploadedContents(tmp.Name(), f, f.Md5)
+	check(later, false)
+	// It's still a conflict if the Drive file changes again.
+	f.Md5 = "editedmd5"
+	check(later, true)
+}
+
+func TestMimeTypeForName(t *testing.T) {
+	config.Upload.Mime_type = []string{".log text/x-log"}
+	defer func() { config.Upload.Mime_type = nil }()
+
+	for _, c := range []struct{ name, expected string }{
+		{"data.csv", "text/csv"},
+		{"REPORT.XLSX", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+		{"x.log", "text/x-log"},
+		{"README", ""},
+	} {
+		if mt := mimeTypeForName(c.name); mt != c.expected {
+			t.Fatalf("%s: expected MIME type %q, got %q", c.name, c.expected, mt)
+		}
+	}
+	if mt := mimeTypeForFile("data.csv", true); mt != encryptedMimeType {
+		t.Fatalf("Expected encrypted MIME type, got %q", mt)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	tmp, err := ioutil.TempFile("", "skicka")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	// Nothing is written before the manifest is opened.
+	addToManifest(manifestEntry{LocalPath: "ignored"}, nil)
+
+	if err := openManifest(tmp.Name()); err != nil {
+		t.Fatalf("%v", err)
+	}
+	f := &gdrive.File{Id: "id", Path: "drive/file", Md5: "md5", FileSize: 12}
+	addToManifest(manifestEntryForFile("/nonexistent", "", f, manifestFailed, ""),
+		errors.New("oops"))
+	if err := closeManifest(); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	b, err := ioutil.ReadFile(tmp.Name())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := `{"local_path":"/nonexistent","drive_path":"drive/file","drive_id":"id",` +
+		`"size":12,"md5":"md5","action":"failed","error":"oops"}` + "\n"
+	if string(b) != expected {
+		t.Fatalf("Expected manifest %s, got %s", expected, string(b))
+	}
+}
+
+func TestTransferFilter(t *testing.T) {
+	sizes := map[string]int64{"0": 0, "512": 512, "1k": 1024, "1.5KB": 1536,
+		"2m": 2 << 20, "1g": 1 << 30, "1t": 1 << 40}
+	for s, expected := range sizes {
+		if v, err := parseSize(s); err != nil || v != expected {
+			t.Fatalf("parseSize(%q): expected %d, got %d (%v)", s, expected, v, err)
+		}
+	}
+	for _, s := range []string{"", "k", "-1", "12x"} {
+		if _, err := parseSize(s); err == nil {
+			t.Fatalf("parseSize(%q): expected error", s)
+		}
+	}
+
+	now := time.Date(2015, 6, 10, 12, 0, 0, 0, time.UTC)
+	times := map[string]time.Time{
+		"36h":                  now.Add(-36 * time.Hour),
+		"7d":                   now.Add(-7 * 24 * time.Hour),
+		"2015-06-01T00:00:00Z": time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC),
+		"2015-06-01":           time.Date(2015, 6, 1, 0, 0, 0, 0, time.Local),
+	}
+	for s, expected := range times {
+		if v, err := parseTimeLimit(s, now); err != nil || !v.Equal(expected) {
+			t.Fatalf("parseTimeLimit(%q): expected %v, got %v (%v)", s, expected, v, err)
+		}
+	}
+	if _, err := parseTimeLimit("yesterday", now); err == nil {
+		t.Fatalf("parseTimeLimit: expected error")
+	}
+
+	tf := transferFilter{MinSize: 10, MaxSize: 100, NewerThan: now.Add(-time.Hour),
+		OlderThan: now}
+	cases := []struct {
+		size     int64
+		modTime  time.Time
+		excluded bool
+	}{
+		{50, now.Add(-time.Minute), false},
+		{5, now.Add(-time.Minute), true},
+		{500, now.Add(-time.Minute), true},
+		{50, now.Add(-2 * time.Hour), true},
+		{50, now, true},
+	}
+	for _, c := range cases {
+		if excluded, reason := tf.excludes(c.size, c.modTime); excluded != c.excluded {
+			t.Fatalf("excludes(%d, %v): expected %v, got %v (%s)", c.size, c.modTime,
+				c.excluded, excluded, reason)
+		}
+	}
+	if excluded, _ := (transferFilter{}).excludes(0, time.Time{}); excluded {
+		t.Fatalf("empty filter excluded a file")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	contents := bytes.Repeat([]byte("2015-06-01 12:00:00 INFO all is well\n"), 10000)
+	tmp, err := ioutil.TempFile("", "skicka")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.Remove(tmp.Name())
+	tmp.Write(contents)
+	tmp.Close()
+
+	uncompressedMD5 := md5.New()
+	r, length, err := getFileContentsReaderForUpload(tmp.Name(), true, false, nil,
+		uncompressedMD5)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	compressed, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if length != -1 {
+		t.Fatalf("Expected unknown length for compressed contents, got %d", length)
+	}
+	if len(compressed) >= len(contents) {
+		t.Fatalf("Compressed size %d not smaller than %d", len(compressed), len(contents))
+	}
+	if sum := md5.Sum(contents); !bytes.Equal(uncompressedMD5.Sum(nil), sum[:]) {
+		t.Fatalf("Uncompressed MD5 checksum doesn't match the contents")
+	}
+
+	f := &gdrive.File{Path: "log.txt", FileSize: int64(len(compressed)),
+		Properties: []gdrive.Property{
+			{Key: compressionProperty, Value: gzipCompression},
+			{Key: uncompressedSizeProperty, Value: "370000"},
+			{Key: uncompressedMd5Property, Value: "md5"}}}
+	if c, err := isCompressed(f); !c || err != nil {
+		t.Fatalf("isCompressed: got %v, %v", c, err)
+	}
+	if size := logicalFileSize(f); size != int64(len(contents)) {
+		t.Fatalf("Expected logical size %d, got %d", len(contents), size)
+	}
+
+	dr, err := makeDecompressionReader(f, bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	decompressed, err := ioutil.ReadAll(dr)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !bytes.Equal(decompressed, contents) {
+		t.Fatalf("Decompressed contents don't match")
+	}
+
+	f.Properties[0].Value = "zstd"
+	if _, err := isCompressed(f); err == nil {
+		t.Fatalf("Expected error for unsupported compression")
+	}
+}
+
+func TestDownloadTempFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skicka")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	localPath := dir + "/file"
+	if err := ioutil.WriteFile(localPath, []byte("old"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	f, offset, err := getLocalWriterForDriveFile(localPath, &gdrive.File{}, false)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	f.Close()
+	if offset != 0 {
+		t.Fatalf("Expected offset 0 for new temporary file, got %d", offset)
+	}
+
+	// The existing file is left alone until the download is complete.
+	if b, err := ioutil.ReadFile(localPath); err != nil || string(b) != "old" {
+		t.Fatalf("Local file changed: %q, %v", string(b), err)
+	}
+	if ignored, _ := isIgnoredForUpload(f.Name()); !ignored {
+		t.Fatalf("Temporary file %s not ignored for upload", f.Name())
+	}
+
+	// A partial download of the current version of a file is resumed,
+	// and partial downloads of other versions are removed.
+	df := &gdrive.File{Id: "id", Md5: "md5", FileSize: 10}
+	partialPath := partialDownloadPath(localPath, df)
+	if err := ioutil.WriteFile(partialPath, []byte("1234"), 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+	oldPartialPath := partialDownloadPath(localPath, &gdrive.File{Id: "id", Md5: "old"})
+	if err := ioutil.WriteFile(oldPartialPath, []byte("12"), 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+	pf, offset, err := getLocalWriterForDriveFile(localPath, df, canResumeDownload(df))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	pf.Close()
+	if pf.Name() != partialPath || offset != 4 {
+		t.Fatalf("Expected to resume %s at 4, got %s at %d", partialPath, pf.Name(),
+			offset)
+	}
+	if _, err := os.Stat(oldPartialPath); !os.IsNotExist(err) {
+		t.Fatalf("Partial download of old version %s not removed", oldPartialPath)
+	}
+
+	// Recent partial downloads are kept; other temporary files aren't.
+	removeStaleDownloads(dir)
+	if _, err := os.Stat(f.Name()); !os.IsNotExist(err) {
+		t.Fatalf("Temporary file %s not removed", f.Name())
+	}
+	if _, err := os.Stat(partialPath); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := os.Stat(localPath); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+// Check that decryption of CFB-encrypted contents can start partway through
+// as downloadDriveFile does when resuming a download: at the preceding block
+// boundary, using the previous block of ciphertext (or the IV) as the IV.
+func TestResumedDecryption(t *testing.T) {
+	key := getRandomBytes(32)
+	iv := getRandomBytes(aes.BlockSize)
+	plaintext := getRandomBytes(1000)
+	stored := append(append([]byte{}, iv...), encryptBytes(key, iv, plaintext)...)
+
+	for _, offset := range []int64{0, 1, 15, 16, 17, 500, 999} {
+		skip := offset % aes.BlockSize
+		start := offset - skip
+		r := bytes.NewReader(stored[start:])
+		blockIV := make([]byte, aes.BlockSize)
+		if _, err := io.ReadFull(r, blockIV); err != nil {
+			t.Fatalf("%v", err)
+		}
+		dr := makeDecryptionReader(key, blockIV, r)
+		if _, err := io.CopyN(ioutil.Discard, dr, skip); err != nil {
+			t.Fatalf("%v", err)
+		}
+		b, err := ioutil.ReadAll(dr)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if !bytes.Equal(b, plaintext[offset:]) {
+			t.Fatalf("offset %d: decrypted contents don't match", offset)
+		}
+	}
+}
+
+func TestOffsetWriter(t *testing.T) {
+	f, err := ioutil.TempFile("", "skicka-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	contents := getRandomBytes(1000)
+	if err := f.Truncate(int64(len(contents))); err != nil {
+		t.Fatalf("%v", err)
+	}
+	// Write the segments out of order, a few bytes at a time.
+	for _, start := range []int{600, 0, 300, 900} {
+		end := start + 300
+		if end > len(contents) {
+			end = len(contents)
+		}
+		w := &offsetWriter{f: f, offset: int64(start)}
+		for i := start; i < end; i += 7 {
+			j := i + 7
+			if j > end {
+				j = end
+			}
+			if _, err := w.Write(contents[i:j]); err != nil {
+				t.Fatalf("%v", err)
+			}
+		}
+	}
+
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !bytes.Equal(b, contents) {
+		t.Fatalf("segments written at offsets don't match contents")
+	}
+}
+
+func TestSegmentLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skicka")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	savedWorkers := nWorkers
+	defer func() { nWorkers = savedWorkers }()
+	nWorkers = 4
+
+	localPath := filepath.Join(dir, "big")
+	f := &gdrive.File{Id: "id", Md5: "md5", FileSize: 4 * downloadSegmentSize}
+	partialPath := partialDownloadPath(localPath, f)
+	if !useSegmentedDownload(f, localPath) {
+		t.Fatalf("Large file not downloaded in segments")
+	}
+
+	log, err := openSegmentLog(partialPath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, start := range []int64{0, 2 * downloadSegmentSize} {
+		if err := log.markDone(nil, start); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	log.close()
+
+	// A partial download with a segment log is resumed in segments, one
+	// without is resumed sequentially.
+	if err := ioutil.WriteFile(partialPath, []byte("partial"), 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !useSegmentedDownload(f, localPath) {
+		t.Fatalf("Partial segmented download not resumed in segments")
+	}
+
+	// A line that was only partly written is ignored.
+	lf, err := os.OpenFile(segmentLogPath(partialPath), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	fmt.Fprintf(lf, "%d", downloadSegmentSize/2)
+	lf.Close()
+
+	log, err = openSegmentLog(partialPath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for start, done := range map[int64]bool{0: true, downloadSegmentSize: false,
+		2 * downloadSegmentSize: true, 3 * downloadSegmentSize: false,
+		downloadSegmentSize / 2: false} {
+		if log.isDone(start) != done {
+			t.Fatalf("Segment at %d: expected done = %v", start, done)
+		}
+	}
+	if err := log.reset(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	log.close()
+	if log, err = openSegmentLog(partialPath); err != nil || log.isDone(0) {
+		t.Fatalf("Segments still done after reset: %v", err)
+	}
+	log.close()
+
+	if err := os.Remove(segmentLogPath(partialPath)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if useSegmentedDownload(f, localPath) {
+		t.Fatalf("Partial sequential download resumed in segments")
+	}
+}
+
+func TestDeleteLocalFilesNotOnDrive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skicka")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	const folder = "application/vnd.google-apps.folder"
+	iv := []gdrive.Property{{Key: "IV", Value: "00"}}
+	files := []*gdrive.File{
+		{Path: "backup", Title: "backup", MimeType: folder},
+		{Path: "backup/a.txt", Title: "a.txt"},
+		{Path: "backup/sub", Title: "sub", MimeType: folder},
+		{Path: "backup/sub/b.txt.aes256", Title: "b.txt.aes256", Properties: iv},
+	}
+	pathMap := createPathMap(files, dir, "/backup")
+
+	tm := time.Date(2015, 6, 1, 12, 30, 0, 0, time.UTC)
+	keep := []string{"a.txt", "sub/b.txt", downloadTempPrefix + "1234",
+		conflictName("a.txt", tm), "sub/" + conflictName("b", tm)}
+	remove := []string{"old.txt", "sub/b.txt.aes256", "gone/c.txt",
+		"a.conflict-2015.txt"}
+	for _, name := range append(keep, remove...) {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := ioutil.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	// Nothing is removed with a dry run.
+	if n := deleteLocalFilesNotOnDrive(dir, pathMap, true); n != 0 {
+		t.Fatalf("%d errors deleting files", n)
+	}
+	for _, name := range remove {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("%s: removed by dry run: %v", name, err)
+		}
+	}
+
+	if n := deleteLocalFilesNotOnDrive(dir, pathMap, false); n != 0 {
+		t.Fatalf("%d errors deleting files", n)
+	}
+	for _, name := range keep {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("%s: expected it to be kept: %v", name, err)
+		}
+	}
+	for _, name := range append(remove, "gone") {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Fatalf("%s: expected it to be deleted: %v", name, err)
+		}
+	}
+}
+
+func TestExportFormats(t *testing.T) {
+	saved := make(map[string]string)
+	for k, v := range exportFormatChoices {
+		saved[k] = v
+	}
+	defer func() { exportFormatChoices = saved }()
+
+	const doc = "application/vnd.google-apps.document"
+	const sheet = "application/vnd.google-apps.spreadsheet"
+	const drawing = "application/vnd.google-apps.drawing"
+	f := &gdrive.File{Title: "Notes", MimeType: doc}
+	if name := localNameForDriveFile(f); name != "Notes.docx" {
+		t.Fatalf("Expected default local name Notes.docx, got %s", name)
+	}
+
+	if err := parseExportFormats("pdf,spreadsheet=csv"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for mimeType, format := range map[string]string{doc: "pdf", sheet: "csv",
+		drawing: "svg"} {
+		if exportFormatChoices[mimeType] != format {
+			t.Fatalf("%s: expected format %s, got %s", mimeType, format,
+				exportFormatChoices[mimeType])
+		}
+	}
+	if _, mimeType, _ := getExportFormat(f); mimeType != "application/pdf" {
+		t.Fatalf("Expected to export as PDF, got %s", mimeType)
+	}
+	if name := localNameForDriveFile(f); name != "Notes.pdf" {
+		t.Fatalf("Expected local name Notes.pdf, got %s", name)
+	}
+
+	// Files whose names already have the extension keep them as is.
+	f.Title = "Report.PDF"
+	if name := localNameForDriveFile(f); name != "Report.PDF" {
+		t.Fatalf("Expected local name Report.PDF, got %s", name)
+	}
+	f = &gdrive.File{Title: "notes.txt"}
+	if name := localNameForDriveFile(f); name != "notes.txt" {
+		t.Fatalf("Extension added to regular file: %s", name)
+	}
+
+	for _, arg := range []string{"doc", "drawing=pdf", "video=mp4", ""} {
+		if err := parseExportFormats(arg); err == nil {
+			t.Fatalf("%q: expected error", arg)
+		}
+	}
+}
+
+func TestConvertedFiles(t *testing.T) {
+	for name, convertible := range map[string]bool{"a.docx": true, "B.XLSX": true,
+		"c.csv": true, "d.pdf": false, "docx": false, "e.docx.aes256": false} {
+		if isConvertible(name) != convertible {
+			t.Fatalf("%s: expected isConvertible() = %v", name, convertible)
+		}
+	}
+
+	tmp, err := ioutil.TempFile("", "skicka-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.Remove(tmp.Name())
+	contents := getRandomBytes(100)
+	if _, err := tmp.Write(contents); err != nil {
+		t.Fatalf("%v", err)
+	}
+	tmp.Close()
+	stat, err := os.Stat(tmp.Name())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	const doc = "application/vnd.google-apps.document"
+	converted := func(size int64, modTime time.Time, md5sum string) *gdrive.File {
+		return &gdrive.File{Path: "doc", MimeType: doc, ModTime: modTime,
+			Properties: []gdrive.Property{
+				{Key: sourceSizeProperty, Value: fmt.Sprintf("%d", size)},
+				{Key: sourceMd5Property, Value: md5sum},
+				{Key: sourceModTimeProperty, Value: formatSourceModTime(modTime)},
+			}}
+	}
+	sum := fmt.Sprintf("%x", md5.Sum(contents))
+	otherSum := fmt.Sprintf("%x", md5.Sum(contents[1:]))
+	otherTime := stat.ModTime().Add(-time.Hour)
+	for _, c := range []struct {
+		name       string
+		f          *gdrive.File
+		trustTimes bool
+		expected   bool
+	}{
+		{"same", converted(100, stat.ModTime(), sum), true, false},
+		{"size", converted(99, stat.ModTime(), sum), true, true},
+		{"time, same contents", converted(100, otherTime, sum), true, false},
+		{"time, other contents", converted(100, otherTime, otherSum), true, true},
+		{"ignoring time", converted(100, stat.ModTime(), otherSum), false, true},
+	} {
+		upload, err := convertedFileNeedsUpload(tmp.Name(), c.f, stat, c.trustTimes, true)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if upload != c.expected {
+			t.Fatalf("%s: expected needs upload = %v", c.name, c.expected)
+		}
+	}
+
+	// Google Docs files that skicka didn't create are left alone.
+	if _, err := convertedFileNeedsUpload(tmp.Name(),
+		&gdrive.File{Path: "doc", MimeType: doc}, stat, true, true); err == nil {
+		t.Fatalf("Expected error for a file that wasn't converted")
+	}
+
+	// Editing the file on Drive changes its modification time.
+	f := converted(100, stat.ModTime(), sum)
+	if convertedFileEditedOnDrive(f) {
+		t.Fatalf("Unedited file reported as edited")
+	}
+	f.ModTime = stat.ModTime().Add(time.Minute)
+	if !convertedFileEditedOnDrive(f) {
+		t.Fatalf("Edit on Drive not detected")
+	}
+}
+
+func TestMD5Verification(t *testing.T) {
+	contents := getRandomBytes(1000)
+	f := &gdrive.File{Md5: fmt.Sprintf("%x", md5.Sum(contents))}
+
+	r := makeMD5VerifyingReader(f, ioutil.NopCloser(bytes.NewReader(contents)))
+	if b, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(b, contents) {
+		t.Fatalf("Verified read failed: %v", err)
+	}
+
+	corrupt := append([]byte{}, contents...)
+	corrupt[500] ^= 1
+	r = makeMD5VerifyingReader(f, ioutil.NopCloser(bytes.NewReader(corrupt)))
+	if _, err := ioutil.ReadAll(r); !isIntegrityError(err) {
+		t.Fatalf("Expected integrity error for corrupt contents, got %v", err)
+	}
+	r = makeMD5VerifyingReader(f, ioutil.NopCloser(bytes.NewReader(contents[:999])))
+	if _, err := ioutil.ReadAll(r); !isIntegrityError(err) {
+		t.Fatalf("Expected integrity error for truncated contents, got %v", err)
+	}
+
+	// Downloads that aren't streamed are verified from the local file.
+	tf, err := ioutil.TempFile("", "skicka-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.Remove(tf.Name())
+	tf.Write(contents)
+	tf.Close()
+	if err := verifyDownloadedFile(tf.Name(), f); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := ioutil.WriteFile(tf.Name(), corrupt, 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := verifyDownloadedFile(tf.Name(), f); !isIntegrityError(err) {
+		t.Fatalf("Expected integrity error for corrupt file, got %v", err)
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	defer func() { duplicates = skipDuplicates }()
+
+	args := []string{"-duplicates=newest", "-duplicates", "largest", "-duplicates=all"}
+	i := 0
+	if ok, err := parseDuplicatesFlag(args, &i, false); !ok || err != nil ||
+		duplicates != newestDuplicate {
+		t.Fatalf("-duplicates=newest: %v, %v, %v", ok, err, duplicates)
+	}
+	i = 1
+	if ok, err := parseDuplicatesFlag(args, &i, false); !ok || err != nil ||
+		duplicates != largestDuplicate || i != 2 {
+		t.Fatalf("-duplicates largest: %v, %v, %v", ok, err, duplicates)
+	}
+	i = 3
+	if _, err := parseDuplicatesFlag(args, &i, false); err == nil {
+		t.Fatalf("Expected -duplicates=all to be rejected for upload")
+	}
+	if ok, _ := parseDuplicatesFlag([]string{"-dry-run"}, new(int), true); ok {
+		t.Fatalf("-dry-run taken as -duplicates")
+	}
+
+	const folder = "application/vnd.google-apps.folder"
+	now := time.Now()
+	older := &gdrive.File{Id: "0Boldfileid", Path: "d/a.txt", Title: "a.txt",
+		FileSize: 200, ModTime: now.Add(-time.Hour)}
+	newer := &gdrive.File{Id: "0Bnewfileid", Path: "d/a.txt", Title: "a.txt",
+		FileSize: 100, ModTime: now}
+	encrypted := &gdrive.File{Id: "0Bencrypted", Path: "d/b.txt.aes256",
+		Title: "b.txt.aes256", ModTime: now}
+	encrypted2 := &gdrive.File{Id: "0Bencrypte2", Path: "d/b.txt.aes256",
+		Title: "b.txt.aes256", ModTime: now.Add(-time.Hour)}
+	dir1 := &gdrive.File{Id: "0Bdir1", Path: "d/sub", Title: "sub", MimeType: folder}
+	dir2 := &gdrive.File{Id: "0Bdir2", Path: "d/sub", Title: "sub", MimeType: folder}
+	subfile := &gdrive.File{Id: "0Bsubfile", Path: "d/sub", Title: "sub", ModTime: now}
+	dupes := map[string][]*gdrive.File{
+		"d/a.txt":        {older, newer},
+		"d/b.txt.aes256": {encrypted2, encrypted},
+		"d/sub":          {subfile, dir1, dir2},
+	}
+
+	files, skipped := resolveDuplicates(dupes, skipDuplicates)
+	if len(files) != 0 || len(skipped) != 3 {
+		t.Fatalf("skip: got %d files, %d skipped", len(files), len(skipped))
+	}
+
+	files, _ = resolveDuplicates(dupes, newestDuplicate)
+	if len(files) != 3 || files[0] != newer || files[1] != encrypted || files[2] != dir1 {
+		t.Fatalf("newest: got %v", files)
+	}
+	files, _ = resolveDuplicates(dupes, largestDuplicate)
+	if files[0] != older {
+		t.Fatalf("largest: got %s", files[0].Id)
+	}
+
+	files, _ = resolveDuplicates(dupes, allDuplicates)
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, f.Path)
+	}
+	expected := []string{"d/a.txt", "d/a~0Boldfil.txt", "d/b.txt.aes256",
+		"d/b~0Bencryp.txt.aes256", "d/sub", "d/sub~0Bsubfil"}
+	if strings.Join(paths, " ") != strings.Join(expected, " ") {
+		t.Fatalf("all: expected %v, got %v", expected, paths)
+	}
+	if older.Path != "d/a.txt" {
+		t.Fatalf("Original file modified: %s", older.Path)
+	}
+}
+
+func TestCreatePathMapDuplicateFolder(t *testing.T) {
+	const folder = "application/vnd.google-apps.folder"
+	files := []*gdrive.File{
+		{Path: "backup", Title: "backup", MimeType: folder},
+		{Path: "backup/d", Title: "d", MimeType: folder},
+		{Path: "backup/d/sub", Title: "sub", MimeType: folder, Id: "1"},
+		{Path: "backup/d/sub", Title: "sub", MimeType: folder, Id: "2"},
+		{Path: "backup/d/sub/x", Title: "x"},
+		{Path: "backup/x", Title: "x"},
+	}
+	// Both of the "sub" folders are dropped, but their children aren't.
+	uniques, multiples := gdrive.PartitionUniquesAndMultiples(files)
+	if len(multiples) != 1 || len(uniques) != 4 {
+		t.Fatalf("Unexpected partition: %d uniques, %d multiples", len(uniques),
+			len(multiples))
+	}
+	pathMap := createPathMap(uniques, "root", "backup")
+	expected := map[string]string{
+		"backup":   "root",
+		"backup/d": filepath.Join("root", "d"),
+		"backup/x": filepath.Join("root", "x"),
+	}
+	if len(pathMap) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, pathMap)
+	}
+	for drivePath, localPath := range expected {
+		if pathMap[drivePath] != localPath {
+			t.Fatalf("%s: expected %s, got %s", drivePath, localPath, pathMap[drivePath])
+		}
+	}
+
+	var nErrors int32
+	downloadable := filesWithLocalPaths(uniques, pathMap, &nErrors)
+	if nErrors != 1 || len(downloadable) != 3 {
+		t.Fatalf("Expected 3 files and 1 error, got %d files and %d errors",
+			len(downloadable), nErrors)
+	}
+
+	// The tar archive also leaves out the file.  (Leave out "backup/x",
+	// which would have to be downloaded.)
+	var buf bytes.Buffer
+	nErrors = 0
+	if err := writeTar(&buf, uniques[:3], pathMap, nil, &nErrors); err != nil || nErrors != 1 {
+		t.Fatalf("writeTar: %v, %d errors", err, nErrors)
+	}
+}
+
+func TestWriteTar(t *testing.T) {
+	const folder = "application/vnd.google-apps.folder"
+	modTime := time.Date(2015, 6, 1, 12, 30, 0, 0, time.UTC)
+	files := []*gdrive.File{
+		{Path: "backup", Title: "backup", MimeType: folder, ModTime: modTime,
+			Properties: []gdrive.Property{{Key: "Permissions", Value: "0700"}}},
+		{Path: "backup/link", Title: "link", MimeType: symlinkMimeType, ModTime: modTime,
+			Properties: makeLongProperty(symlinkTargetProperty, "../target")},
+		{Path: "backup/sub", Title: "sub", MimeType: folder, ModTime: modTime},
+	}
+	names := createPathMap(files, "backup", "backup")
+
+	var buf bytes.Buffer
+	var nErrors int32
+	if err := writeTar(&buf, files, names, nil, &nErrors); err != nil || nErrors != 0 {
+		t.Fatalf("writeTar: %v, %d errors", err, nErrors)
+	}
+
+	expected := []tar.Header{
+		{Name: "backup/", Typeflag: tar.TypeDir, Mode: 0700},
+		{Name: "backup/link", Typeflag: tar.TypeSymlink, Linkname: "../target", Mode: 0777},
+		{Name: "backup/sub/", Typeflag: tar.TypeDir, Mode: 0755},
+	}
+	tr := tar.NewReader(&buf)
+	for _, e := range expected {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("%s: %v", e.Name, err)
+		}
+		if hdr.Name != e.Name || hdr.Typeflag != e.Typeflag || hdr.Mode != e.Mode ||
+			hdr.Linkname != e.Linkname || !hdr.ModTime.Equal(modTime) {
+			t.Fatalf("Expected header %+v, got %+v", e, *hdr)
+		}
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Fatalf("Expected end of archive, got %v", err)
+	}
+
+	// Write errors stop the archive.
+	if err := writeTar(failingWriter{}, files, names, nil, &nErrors); err == nil {
+		t.Fatalf("Expected error writing archive")
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestRestoreDirectoryTimes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skicka")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	const folder = "application/vnd.google-apps.folder"
+	t1 := time.Date(2015, 6, 1, 12, 30, 0, 0, time.UTC)
+	t2 := time.Date(2014, 1, 2, 3, 4, 5, 6000000, time.UTC)
+	files := []*gdrive.File{
+		{Path: "backup", Title: "backup", MimeType: folder, ModTime: t1},
+		{Path: "backup/a.txt", Title: "a.txt", ModTime: t1},
+		{Path: "backup/sub", Title: "sub", MimeType: folder, ModTime: t2},
+	}
+	pathMap := createPathMap(files, dir, "backup")
+	if err := os.Mkdir(pathMap["backup/sub"], 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	var nErrors int32
+	restoreDirectoryTimes(pathMap, files, &nErrors)
+	if nErrors != 0 {
+		t.Fatalf("%d errors restoring directory times", nErrors)
+	}
+	for _, f := range []*gdrive.File{files[0], files[2]} {
+		stat, err := os.Stat(pathMap[f.Path])
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if !stat.ModTime().Equal(f.ModTime) {
+			t.Fatalf("%s: expected modification time %s, got %s", f.Path, f.ModTime,
+				stat.ModTime())
+		}
+	}
+}
+
+func TestMatchMovedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skicka")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	contents := getRandomBytes(100)
+	other := getRandomBytes(100)
+	var mappings []localToRemoteFileMapping
+	for _, n := range []string{"a", "b", "c", "empty"} {
+		data := contents
+		switch n {
+		case "b":
+			data = other
+		case "empty":
+			data = nil
+		}
+		path := filepath.Join(dir, n)
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+		stat, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		mappings = append(mappings, localToRemoteFileMapping{LocalPath: path,
+			DrivePath: "new/" + n, LocalFileInfo: stat})
+	}
+
+	// "a" and "c" both match the first candidate, but it can only be
+	// moved to one of them; "b" has the right size but different contents.
+	moved := &gdrive.File{Path: "old/x", Id: "1", FileSize: 100,
+		Md5: fmt.Sprintf("%x", md5.Sum(contents))}
+	unrelated := &gdrive.File{Path: "old/y", Id: "2", FileSize: 100,
+		Md5: fmt.Sprintf("%x", md5.Sum(getRandomBytes(100)))}
+	candidates := map[int64][]*gdrive.File{100: {moved, unrelated}}
+
+	m := &movedFileMatcher{candidates: candidates, used: make(map[string]bool)}
+	for _, fm := range mappings {
+		f := m.match(fm)
+		if fm.DrivePath == "new/a" && f != moved {
+			t.Fatalf("Expected new/a to be moved from old/x, got %v", f)
+		} else if fm.DrivePath != "new/a" && f != nil {
+			t.Fatalf("Expected %s not to be moved, got %s", fm.DrivePath, f.Path)
+		}
+	}
+}
+
+func TestFileChangedSince(t *testing.T) {
+	tmp, err := ioutil.TempFile("", "skicka")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.Remove(tmp.Name())
+	tmp.Write([]byte("contents"))
+	tmp.Close()
+
+	modTime := time.Date(2015, 6, 1, 12, 30, 0, 0, time.UTC)
+	if err := os.Chtimes(tmp.Name(), modTime, modTime); err != nil {
+		t.Fatalf("%v", err)
+	}
+	stat, err := os.Stat(tmp.Name())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if fileChangedSince(tmp.Name(), stat) {
+		t.Fatalf("Unchanged file reported as changed")
+	}
+
+	// Same size, new modification time.
+	later := modTime.Add(time.Second)
+	if err := os.Chtimes(tmp.Name(), later, later); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !fileChangedSince(tmp.Name(), stat) {
+		t.Fatalf("Change of modification time not detected")
+	}
+
+	// New size, same modification time.
+	if err := ioutil.WriteFile(tmp.Name(), []byte("new contents"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := os.Chtimes(tmp.Name(), modTime, modTime); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !fileChangedSince(tmp.Name(), stat) {
+		t.Fatalf("Change of size not detected")
+	}
+
+	os.Remove(tmp.Name())
+	if !fileChangedSince(tmp.Name(), stat) {
+		t.Fatalf("Removal not detected")
+	}
+}
+
+func TestUploadOfChangingFile(t *testing.T) {
+	tmp, err := ioutil.TempFile("", "skicka")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.Remove(tmp.Name())
+	contents := getRandomBytes(1000)
+	tmp.Write(contents)
+	tmp.Close()
+
+	progressBar := pb.New64(int64(len(contents))).SetUnits(pb.U_BYTES)
+	progressBar.Output = new(DevNullWriter)
+	progressBar.Start()
+	defer progressBar.Finish()
+
+	// The file is modified while each upload is in progress.
+	f := &gdrive.File{Id: "id", Path: "file"}
+	modTime := time.Date(2015, 6, 1, 12, 30, 0, 0, time.UTC)
+	nUploads := 0
+	changingUpload := func(r io.Reader, length int64, try int) error {
+		nUploads++
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			return err
+		}
+		modTime = modTime.Add(time.Second)
+		return os.Chtimes(tmp.Name(), modTime, modTime)
+	}
+	_, _, err = uploadFileContentsWith(tmp.Name(), f, false, false, nil, progressBar,
+		changingUpload)
+	if err == nil {
+		t.Fatalf("Expected upload of changing file to fail")
+	}
+	if nUploads != maxChangedDuringUploadRetries+1 {
+		t.Fatalf("Expected %d uploads, got %d", maxChangedDuringUploadRetries+1, nUploads)
+	}
+	if progressBar.Total != 0 || progressBar.Add64(0) != 0 {
+		t.Fatalf("Progress bar not rolled back: %d of %d bytes",
+			progressBar.Add64(0), progressBar.Total)
+	}
+
+	// The upload succeeds once the file stops changing.
+	nUploads = 0
+	progressBar.SetTotal64(int64(len(contents)))
+	_, md5sum, err := uploadFileContentsWith(tmp.Name(), f, false, false, nil, progressBar,
+		func(r io.Reader, length int64, try int) error {
+			if nUploads == 0 {
+				return changingUpload(r, length, try)
+			}
+			nUploads++
+			_, err := io.Copy(ioutil.Discard, r)
+			return err
+		})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if nUploads != 2 {
+		t.Fatalf("Expected 2 uploads, got %d", nUploads)
+	}
+	if md5sum != fmt.Sprintf("%x", md5.Sum(contents)) {
+		t.Fatalf("Wrong MD5 checksum %s", md5sum)
+	}
+	if progressBar.Add64(0) != int64(len(contents)) {
+		t.Fatalf("Expected progress of %d bytes, got %d", len(contents),
+			progressBar.Add64(0))
+	}
+}
+
+func TestDriveFolders(t *testing.T) {
+	const folder = "application/vnd.google-apps.folder"
+	var mutex sync.Mutex
+	existing := map[string]bool{"": true}
+	var created []string
+	df := &driveFolders{
+		lookup: func(drivePath string) (*gdrive.File, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if existing[drivePath] {
+				return &gdrive.File{Path: drivePath, MimeType: folder}, nil
+			}
+			return nil, gdrive.ErrNotExist
+		},
+		create: func(fm localToRemoteFileMapping) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if !existing[fm.driveParentPath()] {
+				t.Errorf("%s: created before its parent", fm.DrivePath)
+			}
+			created = append(created, fm.DrivePath)
+			if fm.DriveName == "bad" {
+				return errors.New("rate limit exceeded")
+			}
+			existing[fm.DrivePath] = true
+			return nil
+		},
+		dirs:    make(map[string]localToRemoteFileMapping),
+		folders: make(map[string]*driveFolder),
+	}
+	for _, p := range []string{"a", "a/b", "a/b/c", "a/bad", "a/bad/d"} {
+		df.addDir(localToRemoteFileMapping{DrivePath: p, DriveName: filepath.Base(p)})
+	}
+
+	// Many files waiting for the same folders only create them once.
+	var wg sync.WaitGroup
+	errs := make([]error, 20)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				errs[i] = df.ensure("a/b/c")
+			} else {
+				errs[i] = df.ensure("a/bad/d")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if i%2 == 0 && err != nil {
+			t.Fatalf("Unexpected error creating a/b/c: %v", err)
+		} else if i%2 == 1 && err == nil {
+			t.Fatalf("Expected error creating a folder in a/bad")
+		}
+	}
+	if len(created) != 4 {
+		t.Fatalf("Expected a, a/b, a/b/c, and a/bad to be created once, got %v", created)
+	}
+	if df.nErrors != 1 {
+		t.Fatalf("Expected 1 error, got %d", df.nErrors)
+	}
+	if err := df.ensure("elsewhere"); err == nil {
+		t.Fatalf("Expected error for folder that isn't a local directory")
+	}
+}
+
+func TestGrowingProgressBar(t *testing.T) {
+	defer func() { quiet = false }()
+	quiet = false
+
+	var g growingProgressBar
+	if bar := g.add(0); bar != nil {
+		t.Fatalf("Expected no progress bar before anything's been added")
+	}
+	bar := g.add(100)
+	if bar == nil || atomic.LoadInt64(&bar.Total) != 100 {
+		t.Fatalf("Expected progress bar with total 100, got %v", bar)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g.add(10)
+			addToProgressBarTotal(g.get(), -5)
+		}()
+	}
+	wg.Wait()
+	g.finish()
+	if total := atomic.LoadInt64(&bar.Total); total != 150 {
+		t.Fatalf("Expected total 150, got %d", total)
+	}
+}
@@ -0,0 +1,325 @@
+//
+// syncstate.go
+// Copyright(c)2014-2015 Google, Inc.
+//
+// This file is part of skicka.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"github.com/google/skicka/gdrive"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The sync state records, for each local file that has been uploaded or
+// downloaded, the state of the Drive file after the last successful
+// transfer.  If both the local file and the Drive file have changed since
+// then, syncing either way would lose the other side's changes; such
+// files are conflicts, and are handled according to a conflictPolicy.
+
+// syncRecord gives the state of a Drive file when it was last synced;
+// the local file's modification time matched the Drive file's then.
+type syncRecord struct {
+	DriveId string
+	Md5     string
+	ModTime time.Time
+}
+
+var syncState = struct {
+	sync.Mutex
+	// Indexed by absolute local path.
+	records map[string]syncRecord
+	dirty   bool
+}{records: make(map[string]syncRecord)}
+
+// conflictPolicy specifies what's done with files that have been modified
+// both locally and on Drive since they were last synced.
+type conflictPolicy int
+
+const (
+	// Report the conflict and leave both files alone.
+	skipConflicts conflictPolicy = iota
+	// Keep both versions, giving the one that would otherwise be
+	// overwritten a name with a conflict suffix.
+	keepBothOnConflict
+	// Overwrite the destination file anyway.
+	forceOnConflict
+)
+
+// loadSyncState reads the sync state saved in the given file, if it
+// exists.
+func loadSyncState(filename string) error {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	syncState.Lock()
+	defer syncState.Unlock()
+	if err := gob.NewDecoder(f).Decode(&syncState.records); err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	return nil
+}
+
+// saveSyncState writes the sync state to the given file if it has
+// changed since it was loaded.
+func saveSyncState(filename string) error {
+	syncState.Lock()
+	defer syncState.Unlock()
+	if !syncState.dirty {
+		return nil
+	}
+
+	// As with the metadata cache, write a temporary file and then rename
+	// it, so that an interrupted write doesn't leave a partial file.
+	f, err := ioutil.TempFile(filepath.Dir(filename), ".skicka.syncstate")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := gob.NewEncoder(f).Encode(syncState.records); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+func syncStateKey(localPath string) string {
+	if abs, err := filepath.Abs(localPath); err == nil {
+		return abs
+	}
+	return localPath
+}
+
+// recordSync notes that the local file at the given path is in sync with
+// the given Drive file, which has the given MD5 checksum and modification
+// time.
+func recordSync(localPath string, f *gdrive.File, md5 string, modTime time.Time) {
+	r := syncRecord{DriveId: f.Id, Md5: md5, ModTime: normalizeModTime(modTime).UTC()}
+
+	syncState.Lock()
+	defer syncState.Unlock()
+	key := syncStateKey(localPath)
+	if old, ok := syncState.records[key]; !ok || old != r {
+		syncState.records[key] = r
+		syncState.dirty = true
+	}
+}
+
+// recordUploadedContents notes that contents with the given MD5 checksum
+// were uploaded to the given Drive file from the local file at the given
+// path, but that the two aren't in sync, either because the local file
+// changed while it was being uploaded or because the Drive file's
+// modification time couldn't be updated.  The recorded modification time
+// is kept, so the local file is still seen as changed, but the upload
+// itself doesn't make the Drive file look changed; otherwise, uploading
+// the local file again would be a conflict.
+func recordUploadedContents(localPath string, f *gdrive.File, md5 string) {
+	syncState.Lock()
+	defer syncState.Unlock()
+	key := syncStateKey(localPath)
+	r, ok := syncState.records[key]
+	if !ok {
+		// Files that have never been synced can't be conflicts.
+		return
+	}
+	if r.DriveId != f.Id || r.Md5 != md5 {
+		r.DriveId, r.Md5 = f.Id, md5
+		syncState.records[key] = r
+		syncState.dirty = true
+	}
+}
+
+// recordSyncIfUnchanged records the local file and Drive file as being
+// in sync if their modification times match; it's used for files that
+// didn't need to be transferred.
+func recordSyncIfUnchanged(localPath string, f *gdrive.File) {
+	stat, err := os.Stat(localPath)
+	if err != nil || f.IsFolder() || isSymlinkFile(f) || f.Md5 == "" {
+		return
+	}
+	if normalizeModTime(stat.ModTime()).Equal(normalizeModTime(f.ModTime)) {
+		recordSync(localPath, f, f.Md5, f.ModTime)
+	}
+}
+
+// isSyncConflict returns true if both the local file, with the given
+// os.FileInfo, and the given Drive file have changed since they were last
+// synced.  Files that have never been synced aren't conflicts.
+func isSyncConflict(localPath string, stat os.FileInfo, f *gdrive.File) bool {
+	syncState.Lock()
+	r, ok := syncState.records[syncStateKey(localPath)]
+	syncState.Unlock()
+	if !ok {
+		return false
+	}
+
+	localChanged := !normalizeModTime(stat.ModTime()).Equal(r.ModTime)
+	driveChanged := f.Id != r.DriveId || f.Md5 != r.Md5 ||
+		!normalizeModTime(f.ModTime).Equal(r.ModTime)
+	return localChanged && driveChanged
+}
+
+// conflictError is returned for files that are skipped because they're
+// conflicts.
+type conflictError struct {
+	path string
+	op   string
+}
+
+func (e conflictError) Error() string {
+	return fmt.Sprintf("%s: changed both locally and on Drive since it was "+
+		"last synced; not %s (use -keep-both or -force)", e.path, e.op)
+}
+
+// conflictName returns the name to use for the copy of the file with the
+// given name that's kept when there's a conflict.  The conflict suffix
+// goes before the file's extension (and before encryptionSuffix, if
+// present).
+func conflictName(name string, t time.Time) string {
+	suffix := ""
+	if strings.HasSuffix(name, encryptionSuffix) {
+		name = strings.TrimSuffix(name, encryptionSuffix)
+		suffix = encryptionSuffix
+	}
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + ".conflict-" + t.Format("20060102-150405") +
+		ext + suffix
+}
+
+// conflictNameRE matches the names returned by conflictName().
+var conflictNameRE = regexp.MustCompile(`\.conflict-[0-9]{8}-[0-9]{6}(\.|$)`)
+
+// isConflictName returns true if the given file name was returned by
+// conflictName().
+func isConflictName(name string) bool {
+	return conflictNameRE.MatchString(name)
+}
+
+// resolveUploadConflict checks whether the file in the given mapping,
+// which needs to be uploaded, is a conflict, and if so applies the given
+// policy.  For keepBothOnConflict, the Drive file is renamed so that the
+// local file can be uploaded in its place.  It returns true if the file
+// should still be uploaded.
+func resolveUploadConflict(fm localToRemoteFileMapping, policy conflictPolicy,
+	dryRun bool) (bool, error) {
+	stat := fm.LocalFileInfo
+	if stat.IsDir() || isSymlink(stat) {
+		return true, nil
+	}
+	f, err := gd.GetFile(fm.DrivePath)
+	if err != nil {
+		// If the file doesn't exist on Drive, there's nothing to conflict
+		// with.
+		return true, nil
+	}
+	if isConvertedFile(f) {
+		// Converted files don't have sync records, since they have no MD5
+		// checksum on Drive; instead, they record when they were last
+		// converted.
+		if !convertedFileEditedOnDrive(f) {
+			return true, nil
+		}
+	} else if !isSyncConflict(fm.LocalPath, stat, f) {
+		return true, nil
+	}
+
+	switch policy {
+	case forceOnConflict:
+		message("%s: changed both locally and on Drive; overwriting %s",
+			fm.LocalPath, fm.DrivePath)
+		return true, nil
+	case keepBothOnConflict:
+		newName := conflictName(fm.DriveName, time.Now())
+		message("%s: changed both locally and on Drive; moving Drive file to %s",
+			fm.LocalPath, filepath.Join(fm.driveParentPath(), newName))
+		if dryRun {
+			return true, nil
+		}
+		parentFolder, err := gd.GetFile(fm.driveParentPath())
+		if err != nil {
+			return false, err
+		}
+		if f, err = gd.MoveFile(f, parentFolder, newName); err != nil {
+			return false, err
+		}
+		// Otherwise, the renamed file would be downloaded to the original
+		// local name.
+		return true, updateLocalNameProperty(f, nil)
+	default:
+		return false, conflictError{path: fm.LocalPath, op: "uploading"}
+	}
+}
+
+// resolveDownloadConflict is the equivalent of resolveUploadConflict for
+// downloads: it checks whether the local file is a conflict, and, if so,
+// applies the policy.  For keepBothOnConflict, the local file is renamed
+// so that the Drive file can be downloaded.
+func resolveDownloadConflict(localPath string, f *gdrive.File, policy conflictPolicy,
+	dryRun bool) (bool, error) {
+	stat, err := os.Lstat(localPath)
+	if err != nil || !stat.Mode().IsRegular() || !isSyncConflict(localPath, stat, f) {
+		return true, nil
+	}
+
+	switch policy {
+	case forceOnConflict:
+		message("%s: changed both locally and on Drive; overwriting %s",
+			f.Path, localPath)
+		return true, nil
+	case keepBothOnConflict:
+		newPath := filepath.Join(filepath.Dir(localPath),
+			conflictName(filepath.Base(localPath), time.Now()))
+		message("%s: changed both locally and on Drive; moving local file to %s",
+			f.Path, newPath)
+		if dryRun {
+			return true, nil
+		}
+		return true, os.Rename(localPath, newPath)
+	default:
+		return false, conflictError{path: localPath, op: "downloading"}
+	}
+}
+
+// parseConflictFlag handles the command-line flags that set the conflict
+// policy, returning false if the given flag isn't one of them.
+func parseConflictFlag(arg string, policy *conflictPolicy) bool {
+	switch arg {
+	case "-force":
+		*policy = forceOnConflict
+	case "-keep-both":
+		*policy = keepBothOnConflict
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,272 @@
+//
+// tar.go
+// Copyright(c)2014-2015 Google, Inc.
+//
+// This file is part of skicka.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"github.com/cheggaaa/pb"
+	"github.com/google/skicka/gdrive"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// "download -tar" writes the files under a Drive folder to a tar archive
+// rather than to the local filesystem.  The archive is written in order
+// of the files' paths, so the files are written one at a time; to keep
+// the connections busy, smaller files are downloaded ahead of time, in
+// parallel, and held in memory until it's their turn.  Larger files are
+// downloaded as they're written to the archive.  Both share the
+// connections limited by downloadConnections.
+
+// Files up to this size are downloaded ahead of time.  (Google Docs
+// files, whose size isn't known until they're exported, always are.)
+const tarPrefetchMaxSize = 4 * 1024 * 1024
+
+// The result of downloading a file ahead of time.
+type tarPrefetch struct {
+	contents []byte
+	err      error
+}
+
+// downloadTar writes the given Drive file, or all of the files under it if
+// it's a folder, to a tar archive at tarPath, or to the standard output if
+// tarPath is "-".  The archive's entries are named as the files would be
+// named locally, starting with the folder's own name.  It returns the
+// number of errors.
+func downloadTar(drivePath, tarPath string, root *gdrive.File,
+	downloadGoogleAppsFiles bool, dryRun bool, filter transferFilter) int {
+	filesOnDrive := []*gdrive.File{root}
+	if root.IsFolder() {
+		message("Getting list of files to download... ")
+		var err error
+		filesOnDrive, err = gd.GetFilesUnderFolder(drivePath, true)
+		checkFatalError(err, "error getting files from Drive")
+		message("Done. Starting download.\n")
+	}
+	files, nErrors := selectFilesToDownload(filesOnDrive, downloadGoogleAppsFiles,
+		dryRun, filter)
+	names := createPathMap(files, localNameForDriveFile(root), drivePath)
+
+	var totalBytes int64
+	for _, f := range files {
+		totalBytes += logicalFileSize(f)
+	}
+	if dryRun {
+		for _, f := range files {
+			fmt.Printf("%s -> %s:%s (%d bytes)\n", f.Path, tarPath, names[f.Path],
+				logicalFileSize(f))
+		}
+		fmt.Printf("Total bytes %d\n", totalBytes)
+		return int(nErrors)
+	}
+
+	var out *os.File
+	if tarPath == "-" {
+		out = os.Stdout
+	} else {
+		var err error
+		out, err = os.Create(tarPath)
+		checkFatalError(err, "")
+	}
+
+	progressBar := getProgressBar(totalBytes)
+	err := writeTar(out, files, names, progressBar, &nErrors)
+	if progressBar != nil {
+		progressBar.Finish()
+	}
+	if err == nil && config.Download.Fsync && out != os.Stdout {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// The archive can't be used if it's incomplete.
+		if out != os.Stdout {
+			os.Remove(tarPath)
+		}
+		fmt.Fprintf(os.Stderr, "skicka: %s: %v\n", tarPath, err)
+		nErrors++
+	}
+	return int(nErrors)
+}
+
+// writeTar writes the given files, which must be sorted by path, to a tar
+// archive, with the given names.  Files whose contents can't be
+// downloaded ahead of time are left out of the archive, and counted in
+// *nErrors; any other error means that the archive is incomplete and is
+// returned.
+func writeTar(w io.Writer, files []*gdrive.File, names map[string]string,
+	progressBar *pb.ProgressBar, nErrors *int32) error {
+	files = filesWithLocalPaths(files, names, nErrors)
+
+	// Start downloading files ahead of time.  Each of those files gets a
+	// channel that its contents are sent on.  To bound the memory used,
+	// only so many files may be waiting to be written at once.
+	prefetched := make([]chan tarPrefetch, len(files))
+	for i, f := range files {
+		if tarPrefetchable(f) {
+			prefetched[i] = make(chan tarPrefetch, 1)
+		}
+	}
+	window := make(chan bool, 2*nWorkers)
+
+	// If writing the archive fails, no more downloads are started, and
+	// the ones in progress are waited for before returning.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range files {
+			if prefetched[i] == nil {
+				continue
+			}
+			select {
+			case window <- true:
+			case <-done:
+				return
+			}
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				contents, err := downloadToMemory(files[i])
+				prefetched[i] <- tarPrefetch{contents, err}
+			}(i)
+		}
+	}()
+
+	tw := tar.NewWriter(w)
+	for i, f := range files {
+		// As with downloads to the local filesystem, use the permissions
+		// stored on Drive, if there are any.
+		mode, err := getPermissions(f)
+		if err != nil {
+			mode = 0644
+			if f.IsFolder() {
+				mode = 0755
+			}
+		}
+		hdr := &tar.Header{
+			Name:     filepath.ToSlash(names[f.Path]),
+			Mode:     int64(mode),
+			ModTime:  normalizeModTime(f.ModTime),
+			Typeflag: tar.TypeReg,
+		}
+
+		switch {
+		case f.IsFolder():
+			hdr.Name += "/"
+			hdr.Typeflag = tar.TypeDir
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+
+		case isSymlinkFile(f):
+			target, err := getSymlinkTarget(f)
+			if err != nil {
+				addErrorAndPrintMessage(nErrors, f.Path, err)
+				continue
+			}
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = target
+			hdr.Mode = 0777
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+
+		case prefetched[i] != nil:
+			result := <-prefetched[i]
+			<-window
+			if result.err != nil {
+				addErrorAndPrintMessage(nErrors, f.Path, result.err)
+				continue
+			}
+			hdr.Size = int64(len(result.contents))
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err := tarProgressWriter(tw, progressBar).Write(result.contents); err != nil {
+				return err
+			}
+
+		default:
+			// Once the header's been written, the contents have to follow,
+			// so if the download fails, the archive is incomplete.
+			hdr.Size = logicalFileSize(f)
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			acquireDownloadConnection()
+			err := downloadDriveFile(tarProgressWriter(tw, progressBar), f, 0)
+			releaseDownloadConnection()
+			if err != nil {
+				return fmt.Errorf("%s: %v", f.Path, err)
+			}
+		}
+		if !f.IsFolder() {
+			atomic.AddInt64(&stats.LocalFilesUpdated, 1)
+		}
+		verbose.Printf("Added %s to archive as %s", f.Path, hdr.Name)
+	}
+	return tw.Close()
+}
+
+// tarPrefetchable returns true if the given file's contents should be
+// downloaded ahead of time.
+func tarPrefetchable(f *gdrive.File) bool {
+	if f.IsFolder() || isSymlinkFile(f) {
+		return false
+	}
+	return f.IsGoogleAppsFile() || logicalFileSize(f) <= tarPrefetchMaxSize
+}
+
+func tarProgressWriter(w io.Writer, progressBar *pb.ProgressBar) io.Writer {
+	if progressBar == nil {
+		return w
+	}
+	return io.MultiWriter(w, progressBar)
+}
+
+// downloadToMemory returns the contents of the given Drive file,
+// downloading it again if they don't match its MD5 checksum.
+func downloadToMemory(f *gdrive.File) ([]byte, error) {
+	var buf bytes.Buffer
+	for try := 0; ; try++ {
+		buf.Reset()
+		acquireDownloadConnection()
+		err := downloadDriveFile(&buf, f, 0)
+		releaseDownloadConnection()
+		if !isIntegrityError(err) || try == maxIntegrityRetries {
+			return buf.Bytes(), err
+		}
+		fmt.Fprintf(os.Stderr, "skicka: %s: %v; downloading it again\n", f.Path, err)
+	}
+}
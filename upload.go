@@ -21,60 +21,137 @@ package main
 
 import (
 	"crypto/aes"
+	"crypto/md5"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/cheggaaa/pb"
 	"github.com/google/skicka/gdrive"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
 func uploadUsage() {
-	fmt.Printf("Usage: skicka upload [-ignore-times] [-encrypt] [-follow-symlinks <maxdepth>]\n")
+	fmt.Printf("Usage: skicka upload [-ignore-times] [-encrypt]\n")
+	fmt.Printf("       [-follow-symlinks <maxdepth> | -preserve-symlinks]\n")
+	fmt.Printf("       [-preserve-metadata] [-detect-moves] [-copy-existing]\n")
+	fmt.Printf("       [-keep-both | -force] [-convert] [-compress] [-manifest <file>]\n")
+	fmt.Printf("       [-min-size <size>] [-max-size <size>]\n")
+	fmt.Printf("       [-newer-than <time>] [-older-than <time>]\n")
+	fmt.Printf("       [-duplicates=skip|newest|largest]\n")
 	fmt.Printf("       [-dry-run] local_path drive_path\n")
 	fmt.Printf("Run \"skicka help\" for more detailed help text.\n")
 }
 
+// uploadOptions collects the settings that control how a local hierarchy
+// is uploaded; they're mostly given by command-line arguments to "upload".
+type uploadOptions struct {
+	Encrypt    bool
+	TrustTimes bool
+	DryRun     bool
+	// Symlinks are followed up to this depth, unless PreserveSymlinks is
+	// set, in which case they are stored on Drive as links.
+	MaxSymlinkDepth  int
+	PreserveSymlinks bool
+	// Whether file ownership, special mode bits, and extended attributes
+	// should be stored in Drive properties.
+	PreserveMetadata bool
+	// Whether files that were moved or renamed locally should be moved on
+	// Drive, rather than being uploaded again.
+	DetectMoves bool
+	// Whether new files whose contents are already stored elsewhere on
+	// Drive should be copied there on the server, rather than uploaded.
+	CopyExisting bool
+	// What to do with files that have changed both locally and on Drive
+	// since they were last synced.
+	Conflicts conflictPolicy
+	// Whether new office documents should be converted to Google Docs
+	// formats; see convert.go.
+	Convert bool
+	// Whether new files should be compressed before they're uploaded;
+	// see compress.go.
+	Compress bool
+	// Files that are excluded by the filter aren't uploaded.
+	Filter transferFilter
+}
+
 func upload(args []string) int {
 	ignoreTimes := false
-	encrypt := false
-	dryRun := false
+	var opts uploadOptions
+	var manifestFilename string
 
 	if len(args) < 2 {
 		uploadUsage()
 		return 1
 	}
 
+	// Start with the filter settings from the config file; command-line
+	// flags override them.
+	var err error
+	opts.Filter, err = uploadFilterFromConfig()
+	checkFatalError(err, "")
+
 	i := 0
-	maxSymlinkDepth := 0
 	for ; i+2 < len(args); i++ {
 		switch args[i] {
 		case "-ignore-times":
 			ignoreTimes = true
 		case "-encrypt":
-			encrypt = true
+			opts.Encrypt = true
 		case "-dry-run":
-			dryRun = true
+			opts.DryRun = true
 		case "-follow-symlinks":
 			var err error
-			maxSymlinkDepth, err = strconv.Atoi(args[i+1])
+			opts.MaxSymlinkDepth, err = strconv.Atoi(args[i+1])
 			if err != nil {
 				printErrorAndExit(err)
 			}
 			i++
+		case "-preserve-symlinks":
+			opts.PreserveSymlinks = true
+		case "-preserve-metadata":
+			opts.PreserveMetadata = true
+		case "-detect-moves":
+			opts.DetectMoves = true
+		case "-copy-existing":
+			opts.CopyExisting = true
+		case "-convert":
+			opts.Convert = true
+		case "-compress":
+			opts.Compress = true
+		case "-manifest":
+			manifestFilename = args[i+1]
+			i++
 		default:
-			uploadUsage()
-			return 1
+			if isFilter, err := parseFilterFlag(args, &i, &opts.Filter); isFilter {
+				checkFatalError(err, "")
+			} else if isDupes, err := parseDuplicatesFlag(args, &i, false); isDupes {
+				checkFatalError(err, "")
+			} else if !parseConflictFlag(args[i], &opts.Conflicts) {
+				uploadUsage()
+				return 1
+			}
 		}
 	}
-	trustTimes := !ignoreTimes
+	opts.TrustTimes = !ignoreTimes
+
+	if opts.PreserveSymlinks && opts.MaxSymlinkDepth > 0 {
+		printErrorAndExit(fmt.Errorf("-follow-symlinks and -preserve-symlinks " +
+			"can't both be given"))
+	}
+	if opts.Convert && opts.Encrypt {
+		printErrorAndExit(fmt.Errorf("encrypted files can't be converted"))
+	}
 
 	localPath := filepath.Clean(args[i])
 	drivePath := filepath.Clean(args[i+1])
@@ -84,31 +161,37 @@ func upload(args []string) int {
 		printErrorAndExit(err)
 	}
 
-	f := gd.GetFiles(drivePath)
-	switch len(f) {
-	case 0:
+	switch _, err := getDriveFile(drivePath); err {
+	case gdrive.ErrNotExist:
 		// It's fine if the target path doesn't exist, but its parent
 		// directory must be there.
 		p := filepath.Dir(drivePath)
-		switch len(gd.GetFiles(p)) {
-		case 0:
+		switch _, err := getDriveFile(p); err {
+		case gdrive.ErrNotExist:
 			printErrorAndExit(fmt.Errorf("%s: not found", p))
-		case 1:
+		case nil:
 			// LGTM.
 		default:
 			printErrorAndExit(fmt.Errorf("%s: multiple files exist", p))
 		}
-	case 1:
+	case nil:
 		// LGTM.
 	default:
 		printErrorAndExit(fmt.Errorf("%s: multiple files exist", drivePath))
 	}
 
+	if manifestFilename != "" && !opts.DryRun {
+		checkFatalError(openManifest(manifestFilename), "")
+	}
+
 	syncStartTime = time.Now()
-	errs := syncHierarchyUp(localPath, drivePath, encrypt, trustTimes,
-		maxSymlinkDepth, dryRun)
+	errs := syncHierarchyUp(localPath, drivePath, opts)
 	printFinalStats()
 
+	if err := closeManifest(); err != nil {
+		fmt.Fprintf(os.Stderr, "skicka: %s: %v\n", manifestFilename, err)
+		errs++
+	}
 	return errs
 }
 
@@ -117,16 +200,27 @@ type localToRemoteFileMapping struct {
 	LocalPath     string
 	DrivePath     string
 	LocalFileInfo os.FileInfo
+	// The file's name on Drive; this is the last component of DrivePath,
+	// though it may itself contain slashes.  DriveNameProps gives any
+	// properties needed to recover the local name from it (see names.go).
+	DriveName      string
+	DriveNameProps []gdrive.Property
+}
+
+// driveParentPath returns the path of the Drive folder that the file
+// should be stored in.
+func (fm localToRemoteFileMapping) driveParentPath() string {
+	return strings.TrimSuffix(strings.TrimSuffix(fm.DrivePath, fm.DriveName), "/")
 }
 
 // Implement sort.Interface so that we can sort arrays of
-// localToRemoteFileMapping by file size.
-type localToRemoteBySize []localToRemoteFileMapping
+// localToRemoteFileMapping by local path.
+type localToRemoteByPath []localToRemoteFileMapping
 
-func (l2r localToRemoteBySize) Len() int      { return len(l2r) }
-func (l2r localToRemoteBySize) Swap(i, j int) { l2r[i], l2r[j] = l2r[j], l2r[i] }
-func (l2r localToRemoteBySize) Less(i, j int) bool {
-	return l2r[i].LocalFileInfo.Size() < l2r[j].LocalFileInfo.Size()
+func (l2r localToRemoteByPath) Len() int      { return len(l2r) }
+func (l2r localToRemoteByPath) Swap(i, j int) { l2r[i], l2r[j] = l2r[j], l2r[i] }
+func (l2r localToRemoteByPath) Less(i, j int) bool {
+	return l2r[i].LocalPath < l2r[j].LocalPath
 }
 
 // Given a file on the local disk, synchronize it with Google Drive: if the
@@ -134,20 +228,39 @@ func (l2r localToRemoteBySize) Less(i, j int) bool {
 // but has different contents, the contents are updated.  The Unix
 // permissions and file modification time on Drive are also updated
 // appropriately.
-func syncFileUp(localPath string, stat os.FileInfo, drivePath string, encrypt bool,
-	pb *pb.ProgressBar) error {
+func syncFileUp(fm localToRemoteFileMapping, opts uploadOptions, pb *pb.ProgressBar) (err error) {
+	localPath, stat, drivePath := fm.LocalPath, fm.LocalFileInfo, fm.DrivePath
 	debug.Printf("syncFileUp: %s -> %s", localPath, drivePath)
+	encrypt := opts.Encrypt
 
 	// Get the *drive.File for the folder to create the new file in.
-	// This folder should definitely exist at this point, since we
-	// create all folders needed before starting to upload files.
-	parentFolder, err := gd.GetFile(filepath.Dir(drivePath))
+	// This folder should definitely exist at this point, since
+	// driveFolders creates the folders that files need before they're
+	// uploaded.
+	parentFolder, err := getDriveFile(fm.driveParentPath())
 	if err != nil {
-		panic(fmt.Sprintf("%s: get parent directory: %s", filepath.Dir(drivePath), err))
+		panic(fmt.Sprintf("%s: get parent directory: %s", fm.driveParentPath(), err))
 	}
 
-	baseName := filepath.Base(drivePath)
+	baseName := fm.DriveName
 	var driveFile *gdrive.File
+	var contentsMD5 string
+
+	// Record the outcome in the manifest.
+	action, reason := manifestUpdated, ""
+	if _, err := getDriveFile(drivePath); err == gdrive.ErrNotExist {
+		action = manifestCreated
+	}
+	defer func() {
+		if err != nil {
+			action = manifestFailed
+		}
+		e := manifestEntryForFile(localPath, drivePath, driveFile, action, reason)
+		if contentsMD5 != "" {
+			e.Md5 = contentsMD5
+		}
+		addToManifest(e, err)
+	}()
 
 	if stat.IsDir() {
 		// We only get here if the folder doesn't exist at all on Drive; if
@@ -156,36 +269,106 @@ func syncFileUp(localPath string, stat os.FileInfo, drivePath string, encrypt bo
 		var proplist []gdrive.Property
 		proplist = append(proplist, gdrive.Property{Key: "Permissions",
 			Value: fmt.Sprintf("%#o", stat.Mode()&os.ModePerm)})
+		proplist = append(proplist, fm.DriveNameProps...)
+		if opts.PreserveMetadata {
+			mdprops, err := getMetadataProperties(localPath, stat)
+			if err != nil {
+				return err
+			}
+			proplist = append(proplist, mdprops...)
+		}
 		driveFile, err = gd.CreateFolder(baseName, parentFolder, normalizeModTime(stat.ModTime()),
 			proplist)
-		checkFatalError(err, fmt.Sprintf("%s: create folder", drivePath))
+		if err != nil {
+			return err
+		}
 
 		if pb != nil {
 			pb.Increment()
 		}
 		atomic.AddInt64(&stats.UploadBytes, stat.Size())
 		verbose.Printf("Created Google Drive folder %s", drivePath)
+	} else if isSymlink(stat) {
+		// We only get here when symlinks are being preserved; otherwise
+		// they've been resolved when walking the local hierarchy.
+		if driveFile, err = syncSymlinkUp(fm, parentFolder); err != nil {
+			return err
+		}
+	} else if f, err := getDriveFile(drivePath); (err == nil && isConvertedFile(f)) ||
+		(err == gdrive.ErrNotExist && opts.Convert && isConvertible(localPath)) {
+		// Files that were converted when they were uploaded are
+		// converted again.
+		reason = "converted"
+		if driveFile, err = convertFileUp(fm, parentFolder, opts, pb); err != nil {
+			return err
+		}
 	} else {
 		// We're uploading a file.  Create an empty file on Google Drive if
 		// it doesn't already exist.
-		if driveFile, err = gd.GetFile(drivePath); err == gdrive.ErrNotExist {
+		if driveFile, err = getDriveFile(drivePath); err == gdrive.ErrNotExist {
+			var source *gdrive.File
+			var iv []byte
+			if opts.CopyExisting {
+				source, iv = findCopySource(localPath, stat, encrypt)
+			}
+
 			debug.Printf("%s doesn't exist on Drive. Creating", drivePath)
 			var proplist []gdrive.Property
 			if encrypt {
-				// Compute a unique IV for the file.
-				iv := getRandomBytes(aes.BlockSize)
+				if source == nil {
+					// Compute a unique IV for the file.
+					iv = getRandomBytes(aes.BlockSize)
+				}
 				ivhex := hex.EncodeToString(iv)
 				proplist = append(proplist, gdrive.Property{Key: "IV", Value: ivhex})
 			}
 			proplist = append(proplist, gdrive.Property{Key: "Permissions",
 				Value: fmt.Sprintf("%#o", stat.Mode()&os.ModePerm)})
+			proplist = append(proplist, fm.DriveNameProps...)
+			if opts.PreserveMetadata {
+				mdprops, err := getMetadataProperties(localPath, stat)
+				if err != nil {
+					return err
+				}
+				proplist = append(proplist, mdprops...)
+			}
+
+			if source != nil {
+				driveFile, err = copyDriveFile(source, fm, parentFolder, proplist)
+				if err == nil {
+					if pb != nil {
+						pb.Add64(stat.Size())
+					}
+					reason, contentsMD5 = "copied from "+source.Path, source.Md5
+					return nil
+				}
+				if _, gerr := getDriveFile(drivePath); gerr == nil {
+					// The copy was made but its metadata couldn't be
+					// updated; it'll be fixed up on the next upload.
+					return err
+				}
+				fmt.Fprintf(os.Stderr, "skicka: %s: unable to copy from %s, "+
+					"uploading instead: %v\n", drivePath, source.Path, err)
+			}
+
+			mimeType := mimeTypeForFile(localPath, encrypt)
+			if opts.Compress {
+				// uploadFileContents compresses the contents of files
+				// with this property.
+				proplist = append(proplist, gdrive.Property{Key: compressionProperty,
+					Value: gzipCompression})
+				if !encrypt {
+					mimeType = compressedMimeType
+				}
+			}
+
 			// We explicitly set the modification time of the file to the
 			// start of the Unix epoch, so that if the upload fails
 			// partway through, then we won't later be confused about which
 			// file is the correct one from having local and Drive copies
 			// with the same time but different contents.
-			driveFile, err = gd.CreateFile(baseName, parentFolder, time.Unix(0, 0),
-				proplist)
+			driveFile, err = gd.CreateFileWithMimeType(baseName, parentFolder,
+				time.Unix(0, 0), proplist, mimeType)
 
 			if err != nil {
 				return err
@@ -194,8 +377,11 @@ func syncFileUp(localPath string, stat os.FileInfo, drivePath string, encrypt bo
 
 		// And now upload the contents of the file, either overwriting the
 		// contents of the existing file, or adding contents to the
-		// just-created file.
-		if err = uploadFileContents(localPath, driveFile, encrypt, pb); err != nil {
+		// just-created file.  The file may have changed since it was
+		// stat'ed, so the modification time set below is taken from when
+		// its contents were read.
+		stat, contentsMD5, err = uploadFileContents(localPath, driveFile, encrypt, pb)
+		if err != nil {
 			return err
 		}
 	}
@@ -204,36 +390,89 @@ func syncFileUp(localPath string, stat os.FileInfo, drivePath string, encrypt bo
 
 	// Only update the modification time on Google Drive to match the local
 	// modification time after the upload has finished successfully.
-	return gd.UpdateModificationTime(driveFile, normalizeModTime(stat.ModTime()))
+	if err := gd.UpdateModificationTime(driveFile, normalizeModTime(stat.ModTime())); err != nil {
+		if contentsMD5 != "" {
+			recordUploadedContents(localPath, driveFile, contentsMD5)
+		}
+		return err
+	}
+	if contentsMD5 != "" {
+		recordSync(localPath, driveFile, contentsMD5, stat.ModTime())
+	}
+	return nil
 }
 
+// Number of times the upload of a local file that changes while it's
+// being read is retried before giving up on it.
+const maxChangedDuringUploadRetries = 3
+
 // uploadFileContents does its best to upload the local file stored at
 // localPath to the given *drive.File on Google Drive.  (It assumes that
-// the *drive.File has already been created.)
+// the *drive.File has already been created.)  It returns the local file's
+// os.FileInfo as of when its contents were read and the MD5 checksum of the
+// uploaded contents.  If the Drive file is compressed, the local file is
+// compressed as it's uploaded.
 func uploadFileContents(localPath string, driveFile *gdrive.File, encrypt bool,
-	pb *pb.ProgressBar) error {
+	pb *pb.ProgressBar) (os.FileInfo, string, error) {
 	var iv []byte
 	var err error
 	if encrypt {
 		iv, err = getInitializationVector(driveFile)
 		if err != nil {
-			return fmt.Errorf("unable to get IV: %v", err)
+			return nil, "", fmt.Errorf("unable to get IV: %v", err)
 		}
 	}
+	compress, err := isCompressed(driveFile)
+	if err != nil {
+		return nil, "", err
+	}
+
+	upload := func(r io.Reader, length int64, try int) error {
+		// Compressed contents are uploaded with a resumable upload, which
+		// doesn't need to know their length in advance.
+		if length >= resumableUploadMinSize || length < 0 {
+			return gd.UploadFileContentsResumable(driveFile, r, length)
+		}
+		return gd.UploadFileContents(driveFile, r, length, try)
+	}
+	return uploadFileContentsWith(localPath, driveFile, compress, encrypt, iv, pb, upload)
+}
 
+// uploadFileContentsWith does the work of uploadFileContents, using the
+// given function to upload the contents that are read from the given
+// io.Reader, which are of the given length (-1 if it isn't known), on the
+// given try; it's replaceable for testing.
+func uploadFileContentsWith(localPath string, driveFile *gdrive.File, compress, encrypt bool,
+	iv []byte, pb *pb.ProgressBar,
+	upload func(r io.Reader, length int64, try int) error) (os.FileInfo, string, error) {
+	nChanged := 0
 	for try := 0; ; try++ {
-		contentsReader, length, err :=
-			getFileContentsReaderForUpload(localPath, encrypt, iv)
-		if contentsReader != nil {
-			defer contentsReader.Close()
+		stat, err := os.Stat(localPath)
+		if err != nil {
+			return nil, "", err
 		}
+
+		// The uncompressed contents' MD5 checksum is stored in a
+		// property; it's computed as the contents are read for
+		// compression, so that the file is only read once.
+		var uncompressedMD5 hash.Hash
+		if compress {
+			uncompressedMD5 = md5.New()
+		}
+
+		contentsReader, length, err :=
+			getFileContentsReaderForUpload(localPath, compress, encrypt, iv,
+				uncompressedMD5)
 		if err != nil {
-			return err
+			return nil, "", err
 		}
 
 		// Keep track of how many bytes are uploaded in case we fail
 		// part-way through and need to roll back the progress bar.
-		countingReader := &byteCountingReader{R: contentsReader}
+		// The MD5 checksum is computed as the contents are read so that
+		// the sync state can be updated after the upload.
+		md5sum := md5.New()
+		countingReader := &byteCountingReader{R: io.TeeReader(contentsReader, md5sum)}
 
 		// Also tee reads to the progress bar as they are done so that it
 		// stays in sync with how much data has been transmitted.
@@ -244,18 +483,40 @@ func uploadFileContents(localPath string, driveFile *gdrive.File, encrypt bool,
 			uploadReader = countingReader
 		}
 
-		if length >= resumableUploadMinSize {
-			err = gd.UploadFileContentsResumable(driveFile, uploadReader, length)
+		err = upload(uploadReader, length, try)
+		uploaded := err == nil
+		// Close the file now rather than when returning, so that retries
+		// don't each leave another one open.
+		contentsReader.Close()
+		if compress {
+			atomic.AddInt64(&stats.DiskReadBytes, stat.Size())
 		} else {
-			err = gd.UploadFileContents(driveFile, uploadReader, length, try)
+			atomic.AddInt64(&stats.DiskReadBytes, countingReader.bytesRead)
 		}
-		atomic.AddInt64(&stats.DiskReadBytes, countingReader.bytesRead)
 
-		if err == nil {
+		// If the file was written to while it was being read, what was
+		// uploaded may be a mix of its old and new contents.
+		changed := fileChangedSince(localPath, stat) ||
+			(err == nil && length >= 0 && countingReader.bytesRead != length)
+
+		if err == nil && !changed && compress {
+			err = setUncompressedProperties(driveFile, stat.Size(),
+				hex.EncodeToString(uncompressedMD5.Sum(nil)))
+		}
+		if err == nil && !changed {
 			// Success!
+			if compress && pb != nil {
+				// The progress bar expects the uncompressed size.
+				pb.Add64(stat.Size() - countingReader.bytesRead)
+			}
 			atomic.AddInt64(&stats.DriveFilesUpdated, 1)
-			atomic.AddInt64(&stats.UploadBytes, length)
-			return nil
+			atomic.AddInt64(&stats.UploadBytes, countingReader.bytesRead)
+			return stat, hex.EncodeToString(md5sum.Sum(nil)), nil
+		}
+		if uploaded {
+			// The Drive file's contents have been replaced, even though
+			// they may be torn.
+			recordUploadedContents(localPath, driveFile, hex.EncodeToString(md5sum.Sum(nil)))
 		}
 
 		// The "progress" made so far on this file should be rolled back;
@@ -265,40 +526,173 @@ func uploadFileContents(localPath string, driveFile *gdrive.File, encrypt bool,
 			pb.Add64(-countingReader.bytesRead)
 		}
 
-		if re, ok := err.(gdrive.RetryHTTPTransmitError); ok && try < 5 {
+		if changed && nChanged < maxChangedDuringUploadRetries {
+			debug.Printf("%s: changed during upload--retrying", localPath)
+			nChanged++
+		} else if changed {
+			// Give up, leaving the file's modification time on Drive
+			// as it was, so that it will be uploaded again next time.
+			addToProgressBarTotal(pb, -stat.Size())
+			return nil, "", fmt.Errorf("changed during upload")
+		} else if re, ok := err.(gdrive.RetryHTTPTransmitError); ok && try < 5 {
 			debug.Printf("%s: got retry http error--retrying: %s",
 				localPath, re.Error())
 		} else {
 			debug.Printf("%s: giving up due to error: %v", localPath, err)
 			// We're giving up on this file, so subtract its length from
 			// what the progress bar is expecting.
-			if pb != nil {
-				pb.Total -= length
-			}
-			return err
+			addToProgressBarTotal(pb, -stat.Size())
+			return nil, "", err
 		}
 	}
 }
 
+// driveFolders creates the Drive folders for the local directories being
+// uploaded as they're needed: when a file that goes in one of them is
+// about to be uploaded, or when the directory itself has been found to
+// need uploading.  Each folder's parent is created before it, and each
+// folder is only created once, however many files are waiting for it.
+type driveFolders struct {
+	// Returns the Drive file at the given path; replaceable for testing.
+	lookup func(drivePath string) (*gdrive.File, error)
+	// Creates the Drive folder for the given local directory, whose
+	// parent folder exists; replaceable for testing.
+	create func(fm localToRemoteFileMapping) error
+
+	mutex sync.Mutex
+	// Local directories found so far, indexed by their Drive paths.
+	dirs map[string]localToRemoteFileMapping
+	// Drive folders that have been, or are being, looked up or created,
+	// indexed by their paths.
+	folders map[string]*driveFolder
+	// Number of folders that couldn't be created.
+	nErrors int32
+}
+
+type driveFolder struct {
+	// Closed once the folder has been looked up or created.
+	done chan struct{}
+	err  error
+}
+
+func newDriveFolders(opts uploadOptions) *driveFolders {
+	return &driveFolders{
+		lookup: getDriveFile,
+		create: func(fm localToRemoteFileMapping) error {
+			return syncFileUp(fm, opts, nil)
+		},
+		dirs:    make(map[string]localToRemoteFileMapping),
+		folders: make(map[string]*driveFolder),
+	}
+}
+
+// addDir records the given local directory so that its Drive folder can
+// be created when it's needed.  Directories have to be added before any
+// of the files in them need their folders.
+func (df *driveFolders) addDir(fm localToRemoteFileMapping) {
+	df.mutex.Lock()
+	defer df.mutex.Unlock()
+	df.dirs[fm.DrivePath] = fm
+}
+
+// ensure makes sure that the Drive folder at the given path exists,
+// creating it and its parent folders if they don't.  It returns an error
+// if the folder couldn't be created; errors creating a folder are only
+// reported once, by the goroutine that tried to create it.
+func (df *driveFolders) ensure(drivePath string) error {
+	df.mutex.Lock()
+	if f, ok := df.folders[drivePath]; ok {
+		df.mutex.Unlock()
+		<-f.done
+		return f.err
+	}
+	f := &driveFolder{done: make(chan struct{})}
+	df.folders[drivePath] = f
+	fm, ok := df.dirs[drivePath]
+	df.mutex.Unlock()
+
+	f.err = df.makeFolder(drivePath, fm, ok)
+	close(f.done)
+	return f.err
+}
+
+func (df *driveFolders) makeFolder(drivePath string, fm localToRemoteFileMapping,
+	isLocalDir bool) error {
+	folder, err := df.lookup(drivePath)
+	switch {
+	case err == nil && folder.IsFolder():
+		return nil
+	case err == nil:
+		// This was already reported when the local directory was checked.
+		return fmt.Errorf("%s: is a regular file on Drive", drivePath)
+	case err != gdrive.ErrNotExist:
+	case !isLocalDir:
+		err = errors.New("not found")
+	default:
+		if perr := df.ensure(fm.driveParentPath()); perr != nil {
+			addToManifest(manifestEntryForFile(fm.LocalPath, fm.DrivePath, nil,
+				manifestSkipped, "parent folder couldn't be created"), nil)
+			return perr
+		}
+		if err = df.create(fm); err == nil {
+			return nil
+		}
+	}
+	addErrorAndPrintMessage(&df.nErrors, fmt.Sprintf("%s: unable to create folder; "+
+		"skipping its contents", drivePath), err)
+	return err
+}
+
+// fileChangedSince reports whether the local file at the given path has
+// been modified or removed since the given os.FileInfo was obtained.
+func fileChangedSince(path string, stat os.FileInfo) bool {
+	newStat, err := os.Stat(path)
+	return err != nil || newStat.Size() != stat.Size() ||
+		!newStat.ModTime().Equal(stat.ModTime())
+}
+
 // Synchronize a local directory hierarchy with Google Drive.
 // localPath is the file or directory to start with, driveRoot is
 // the directory into which the file/directory will be sent
-func syncHierarchyUp(localPath string, driveRoot string, encrypt bool, trustTimes bool,
-	maxSymlinkDepth int, dryRun bool) int {
+func syncHierarchyUp(localPath string, driveRoot string, opts uploadOptions) int {
+	encrypt := opts.Encrypt
 	if encrypt && key == nil {
 		key = decryptEncryptionKey()
 	}
 
-	fileMappings, nUploadErrors := compileUploadFileTree(localPath, driveRoot,
-		encrypt, trustTimes, maxSymlinkDepth, dryRun)
-	if len(fileMappings) == 0 {
-		message("No files to be uploaded.")
-		return 0
+	// Files that were moved or renamed locally are moved on Drive rather
+	// than uploaded again.
+	var moves *movedFileMatcher
+	if opts.DetectMoves {
+		moves = findMovedFileCandidates(localPath, driveRoot, opts.Encrypt)
 	}
 
-	if dryRun {
+	// The local files are checked in parallel with the uploads; each one
+	// that needs to be uploaded is sent over toUploadChan as soon as it's
+	// been checked.
+	folders := newDriveFolders(opts)
+	toUploadChan := make(chan localToRemoteFileMapping, 128)
+	var nUploadErrors int32
+	go func() {
+		nErrs := compileUploadFileTree(localPath, driveRoot, opts, folders, toUploadChan)
+		atomic.AddInt32(&nUploadErrors, nErrs)
+		close(toUploadChan)
+	}()
+
+	if opts.DryRun {
+		var fileMappings []localToRemoteFileMapping
+		for fm := range toUploadChan {
+			fileMappings = append(fileMappings, fm)
+		}
+		sort.Sort(localToRemoteByPath(fileMappings))
+
 		var totalSize int64
 		for _, f := range fileMappings {
+			if from := moves.movedFrom(f); from != nil {
+				fmt.Printf("%s -> %s (moved from %s)\n", f.LocalPath, f.DrivePath,
+					from.Path)
+				continue
+			}
 			fmt.Printf("%s -> %s (%d bytes)\n", f.LocalPath, f.DrivePath,
 				f.LocalFileInfo.Size())
 			totalSize += f.LocalFileInfo.Size()
@@ -307,89 +701,53 @@ func syncHierarchyUp(localPath string, driveRoot string, encrypt bool, trustTime
 		return 0
 	}
 
-	nBytesToUpload := int64(0)
-	for _, info := range fileMappings {
-		if !info.LocalFileInfo.IsDir() {
-			nBytesToUpload += info.LocalFileInfo.Size()
-		}
-	}
+	// The total size of the files to upload isn't known until they've all
+	// been checked, so the progress bar grows as they're found.
+	var progressBar growingProgressBar
 
-	// Given the list of files to sync, first find all of the directories and
-	// then either get or create a Drive folder for each one.
-	directoryMappingMap := make(map[string]localToRemoteFileMapping)
-	var directoryNames []string
-	for _, localfile := range fileMappings {
-		if localfile.LocalFileInfo.IsDir() {
-			directoryNames = append(directoryNames, localfile.DrivePath)
-			directoryMappingMap[localfile.DrivePath] = localfile
-		}
-	}
+	// Large files that use the resumable upload protocol are uploaded one
+	// at a time; more of them at once doesn't generally help improve
+	// bandwidth utilizaiton and seems to make rate limit errors from the
+	// Drive API more frequent...
+	largeUploads := make(chan struct{}, 1)
 
-	// Now sort the directories by name, which ensures that the parent of each
-	// directory has already been created if we need to create its children.
-	sort.Strings(directoryNames)
-
-	if len(directoryNames) > 0 {
-		// Actually create/update the directories.
-		var dirProgressBar *pb.ProgressBar
-		if !quiet {
-			dirProgressBar = pb.New(len(directoryNames))
-			dirProgressBar.Output = os.Stderr
-			dirProgressBar.Prefix("Directories: ")
-			dirProgressBar.Start()
+	nToUpload := int32(0)
+	upload := func(fm localToRemoteFileMapping) {
+		atomic.AddInt32(&nToUpload, 1)
+		if fm.LocalFileInfo.IsDir() {
+			// Errors are reported by driveFolders.ensure().
+			folders.ensure(fm.DrivePath)
+			return
+		}
+		if err := folders.ensure(fm.driveParentPath()); err != nil {
+			verbose.Printf("%s: skipping, since its Drive folder couldn't "+
+				"be created", fm.LocalPath)
+			addToManifest(manifestEntryForFile(fm.LocalPath, fm.DrivePath, nil,
+				manifestSkipped, "parent folder couldn't be created"), nil)
+			return
 		}
 
-		// Sync each of the directories, which serves to create any missing ones.
-		for _, dirName := range directoryNames {
-			file := directoryMappingMap[dirName]
-			err := syncFileUp(file.LocalPath, file.LocalFileInfo, file.DrivePath,
-				encrypt, dirProgressBar)
-			if err != nil {
-				// Errors creating directories are basically unrecoverable,
-				// as they'll prevent us from later uploading any files in
-				// them.
-				printErrorAndExit(err)
+		if from := moves.movedFrom(fm); from != nil {
+			err := moveDriveFile(from, fm, opts)
+			if err == nil {
+				return
 			}
+			fmt.Fprintf(os.Stderr, "skicka: %s: unable to move from %s; "+
+				"uploading instead: %v\n", fm.DrivePath, from.Path, err)
 		}
-		if dirProgressBar != nil {
-			dirProgressBar.Finish()
-		}
-	}
 
-	var fileProgressBar *pb.ProgressBar
-	if !quiet {
-		fileProgressBar = pb.New64(nBytesToUpload).SetUnits(pb.U_BYTES)
-		fileProgressBar.Output = os.Stderr
-		fileProgressBar.Prefix("Files: ")
-		fileProgressBar.Start()
-	}
-
-	// Sort the files by size, small to large.
-	sort.Sort(localToRemoteBySize(fileMappings))
-
-	// The two indices uploadFrontIndex and uploadBackIndex point to the
-	// range of elements in the fileMappings array that haven't yet been
-	// uploaded.
-	uploadFrontIndex := 0
-	uploadBackIndex := len(fileMappings) - 1
-
-	// First, upload any large files that will use the resumable upload
-	// protocol using a single thread; more threads here doesn't generally
-	// help improve bandwidth utilizaiton and seems to make rate limit
-	// errors from the Drive API more frequent...
-	for ; uploadBackIndex >= 0; uploadBackIndex-- {
-		if fileMappings[uploadBackIndex].LocalFileInfo.Size() < resumableUploadMinSize {
-			break
+		var size int64
+		if !isSymlink(fm.LocalFileInfo) {
+			size = fm.LocalFileInfo.Size()
 		}
-
-		fm := fileMappings[uploadBackIndex]
-		if fm.LocalFileInfo.IsDir() {
-			continue
+		bar := progressBar.add(size)
+		if size >= resumableUploadMinSize {
+			largeUploads <- struct{}{}
+			defer func() { <-largeUploads }()
 		}
-
-		if err := syncFileUp(fm.LocalPath, fm.LocalFileInfo, fm.DrivePath, encrypt,
-			fileProgressBar); err != nil {
-			addErrorAndPrintMessage(&nUploadErrors, fm.LocalPath, err)
+		if err := syncFileUp(fm, opts, bar); err != nil {
+			atomic.AddInt32(&nUploadErrors, 1)
+			fmt.Fprintf(os.Stderr, "\nskicka: %s: %v\n", fm.LocalPath, err)
 		}
 	}
 
@@ -397,71 +755,26 @@ func syncHierarchyUp(localPath string, driveRoot string, encrypt bool, trustTime
 	// they're done; the code that launches them waits for all of them
 	// to do so before returning.
 	doneChan := make(chan int, nWorkers)
-
-	// Now that multiple threads are running, we need a mutex to protect
-	// access to uploadFrontIndex and uploadBackIndex.
-	var uploadIndexMutex sync.Mutex
-
-	// All but one of the upload threads will grab files to upload starting
-	// from the begining of the fileMappings array, thus doing the smallest
-	// files first; one thread starts from the back of the array, doing the
-	// largest files first.  In this way, the large files help saturate the
-	// available upload bandwidth and hide the fixed overhead of creating
-	// the smaller files.
-	uploadWorker := func(startFromFront bool) {
-		for {
-			uploadIndexMutex.Lock()
-			if uploadFrontIndex > uploadBackIndex {
-				// All files have been uploaded.
-				debug.Printf("All files uploaded [%d,%d]; exiting",
-					uploadFrontIndex, uploadBackIndex)
-				uploadIndexMutex.Unlock()
-				doneChan <- 1
-				break
-			}
-
-			// Get the index into fileMappings for the next file this
-			// worker should upload.
-			var index int
-			if startFromFront {
-				index = uploadFrontIndex
-				uploadFrontIndex++
-			} else {
-				index = uploadBackIndex
-				uploadBackIndex--
-			}
-			uploadIndexMutex.Unlock()
-
-			fm := fileMappings[index]
-			if fm.LocalFileInfo.IsDir() {
-				// Directories have already been taken care of.
-				continue
-			}
-
-			err := syncFileUp(fm.LocalPath, fm.LocalFileInfo, fm.DrivePath, encrypt,
-				fileProgressBar)
-			if err != nil {
-				atomic.AddInt32(&nUploadErrors, 1)
-				fmt.Fprintf(os.Stderr, "\nskicka: %s: %v\n", fm.LocalPath, err)
-			}
-		}
-	}
-
-	// Launch the workers.
 	for i := 0; i < nWorkers; i++ {
-		// All workers except the first one start from the front of
-		// the array.
-		go uploadWorker(i != 0)
+		go func() {
+			for fm := range toUploadChan {
+				upload(fm)
+			}
+			debug.Printf("Worker exiting")
+			doneChan <- 1
+		}()
 	}
 
 	// Wait for all of the workers to finish.
 	for i := 0; i < nWorkers; i++ {
 		<-doneChan
 	}
-	if fileProgressBar != nil {
-		fileProgressBar.Finish()
-	}
+	progressBar.finish()
+	nUploadErrors += folders.nErrors
 
+	if nToUpload == 0 {
+		message("No files to be uploaded.")
+	}
 	if nUploadErrors > 0 {
 		fmt.Fprintf(os.Stderr, "skicka: %d files not uploaded due to errors. "+
 			"This may be a transient failure; try uploading again.\n", nUploadErrors)
@@ -477,39 +790,34 @@ func isSymlink(stat os.FileInfo) bool {
 // Starts with the efficient checks that may be able to let us quickly
 // determine one way or the other before going to the more expensive ones.
 func fileNeedsUpload(localPath, drivePath string, stat os.FileInfo,
-	encrypt, trustTimes bool, dryRun bool) (bool, error) {
+	opts uploadOptions) (bool, error) {
+	encrypt, trustTimes, dryRun := opts.Encrypt, opts.TrustTimes, opts.DryRun
+
 	// Don't upload if the filename matches one of the regular expressions
 	// of files to ignore.
-	for _, re := range config.Upload.Ignored_Regexp {
-		match, err := regexp.MatchString(re, localPath)
-		if match == true {
-			verbose.Printf("skicka: %s: ignoring file, which "+
-				"matches regexp \"%s\".\n", localPath, re)
-			return false, nil
-		}
-		if err != nil {
-			return false, err
-		}
+	if ignored, err := isIgnoredForUpload(localPath); ignored || err != nil {
+		return false, err
 	}
 
-	if isSymlink(stat) {
+	if isSymlink(stat) && !opts.PreserveSymlinks {
 		// This shouldn't happen.
 		return false, fmt.Errorf("%s: unexpected symlink", localPath)
 	}
 
 	// See if the file exists: if not, then we definitely need to do the
 	// upload.
-	driveFile, err := gd.GetFile(drivePath)
+	driveFile, err := getDriveFile(drivePath)
 	if err == gdrive.ErrNotExist {
 		debug.Printf("drive file %s doesn't exist -> needs upload", drivePath)
 		return true, nil
 	} else if err == gdrive.ErrMultipleFiles {
 		// If there are multiple files with this name on Drive (as is
 		// allowed), then we're going to ignore this file, since it's non
-		// obvious what the right thing to do it.
+		// obvious what the right thing to do it.  (getDriveFile() only
+		// returns this error if -duplicates doesn't give a policy.)
 		fmt.Fprintf(os.Stderr, "skicka: %s: multiple files/folders with this name exist "+
-			"in Google Drive. Skipping all files in this hierarchy.\n",
-			drivePath)
+			"in Google Drive. Skipping all files in this hierarchy; use "+
+			"-duplicates to choose one of them.\n", drivePath)
 		return false, nil
 	} else if err != nil {
 		// Some other error.
@@ -529,6 +837,17 @@ func fileNeedsUpload(localPath, drivePath string, stat os.FileInfo,
 		return false, fmt.Errorf("%s: is regular file, but %s on Drive is a folder",
 			localPath, drivePath)
 	}
+	if isSymlink(stat) != isSymlinkFile(driveFile) {
+		if isSymlink(stat) {
+			return false, fmt.Errorf("%s: is symbolic link, but %s on Drive is a "+
+				"regular file", localPath, drivePath)
+		}
+		return false, fmt.Errorf("%s: is regular file, but %s on Drive is a "+
+			"symbolic link", localPath, drivePath)
+	}
+	if isSymlink(stat) {
+		return symlinkNeedsUpload(localPath, driveFile, stat, dryRun)
+	}
 
 	// FIXME: a function named "fileNeedsUpload()" shouldn't be messing
 	// around with creating properties, upading modification times, etc.;
@@ -551,6 +870,12 @@ func fileNeedsUpload(localPath, drivePath string, stat os.FileInfo,
 			return false, err
 		}
 
+		if opts.PreserveMetadata {
+			if err := updateMetadataProperties(driveFile, localPath, stat); err != nil {
+				return false, err
+			}
+		}
+
 		// If it's a directory, once it's created and the permissions and times
 		// are updated (if needed), we're all done.
 		if stat.IsDir() {
@@ -559,9 +884,27 @@ func fileNeedsUpload(localPath, drivePath string, stat os.FileInfo,
 		}
 	}
 
+	if driveFile.IsGoogleAppsFile() {
+		return convertedFileNeedsUpload(localPath, driveFile, stat, trustTimes, dryRun)
+	}
+
+	// Compressed files are compared to the size and MD5 checksum of
+	// the local file when it was uploaded, rather than the Drive file's.
+	compressed, err := isCompressed(driveFile)
+	if err != nil {
+		return false, err
+	}
+	driveMD5 := driveFile.Md5
+
 	// Compare file sizes.
 	localSize, driveSize := stat.Size(), driveFile.FileSize
-	if encrypt {
+	if compressed {
+		if driveSize, driveMD5, err = getUncompressedSizeAndMD5(driveFile); err != nil {
+			// Most likely the upload was interrupted; upload it again.
+			debug.Printf("%s: %v; adding file to upload list", localPath, err)
+			return true, nil
+		}
+	} else if encrypt {
 		// We store a copy of the initialization vector at the start of
 		// the file stored in Google Drive; account for this when
 		// comparing the file sizes.
@@ -588,7 +931,7 @@ func fileNeedsUpload(localPath, drivePath string, stat os.FileInfo,
 	// don't trust them.  Therefore, we'll now go through the work of
 	// computing MD5 checksums of file contents to make a final decision.
 	var iv []byte
-	if encrypt {
+	if encrypt && !compressed {
 		iv, err = getInitializationVector(driveFile)
 		if err != nil {
 			return false, fmt.Errorf("unable to get IV: %v", err)
@@ -596,11 +939,11 @@ func fileNeedsUpload(localPath, drivePath string, stat os.FileInfo,
 	}
 
 	// Check if the saved MD5 on Drive is the same when it's recomputed locally
-	md5local, err := localFileMD5Contents(localPath, encrypt, iv)
+	md5local, err := localFileMD5Contents(localPath, encrypt && !compressed, iv)
 	if err != nil {
 		return false, err
 	}
-	if md5local != driveFile.Md5 {
+	if md5local != driveMD5 {
 		// The contents of the local file and the remote file differ.
 
 		if timeMatches {
@@ -661,12 +1004,65 @@ func resolveSymlinks(path string, stat os.FileInfo, maxSymlinkDepth *int) (strin
 }
 
 // Walk the local filesystem starting at localPath; for each file
-// encountered, determine if the file needs to be uploaded. If so, an entry
-// is added to the returned localToRemoteFileMapping array.
-func walkPathForUploads(localPath, drivePath string, encrypt,
-	trustTimes bool, maxSymlinkDepth int, dryRun bool) ([]localToRemoteFileMapping, int32) {
-	var fileMappings []localToRemoteFileMapping
+// encountered, determine if the file needs to be uploaded. If so, it's
+// sent on toUploadChan.  Directories are added to folders as they're
+// found.  driveName and nameProps give the name of the Drive file
+// corresponding to localPath and properties needed to recover its local
+// name (see names.go).  It returns the number of errors.
+func walkPathForUploads(localPath, drivePath, driveName string, nameProps []gdrive.Property,
+	opts uploadOptions, folders *driveFolders,
+	toUploadChan chan<- localToRemoteFileMapping) int32 {
+	// Deciding whether a file needs to be uploaded may require computing
+	// its MD5 checksum, so the files found by the walk are checked by a
+	// pool of workers while the walk continues.
+	toCheckChan := make(chan localToRemoteFileMapping, 128)
+	nErrs := int32(0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < nWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fm := range toCheckChan {
+				upload, err := fileNeedsUploadWithoutConflict(fm, opts)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "skicka: %s\n", err)
+					atomic.AddInt32(&nErrs, 1)
+				} else if upload {
+					toUploadChan <- fm
+				}
+			}
+		}()
+	}
+
+	ne := walkLocalPath(localPath, drivePath, driveName, nameProps, opts,
+		func(fm localToRemoteFileMapping) {
+			// Record directories before any of their contents are
+			// checked, so that their folders can be created for them.
+			if fm.LocalFileInfo.IsDir() {
+				folders.addDir(fm)
+			}
+			toCheckChan <- fm
+		})
+	close(toCheckChan)
+	wg.Wait()
+	return nErrs + ne
+}
+
+// walkLocalPath walks the local filesystem starting at localPath,
+// following symlinks as allowed by opts, and calls visit with the mapping
+// for each file and directory encountered.  driveName and nameProps are
+// as for walkPathForUploads.  It returns the number of errors encountered.
+func walkLocalPath(localPath, drivePath, driveName string, nameProps []gdrive.Property,
+	opts uploadOptions, visit func(localToRemoteFileMapping)) int32 {
 	nErrs := int32(0)
+	localPath = filepath.Clean(localPath)
+	driveRoot := drivePath
+
+	// Map from local directories to the corresponding Drive paths.  Drive
+	// paths can't just be computed from relative local paths, since local
+	// file names are mapped to Drive names individually.
+	dirDrivePaths := make(map[string]string)
 
 	pathWalkFunc := func(path string, stat os.FileInfo, patherr error) error {
 		path = filepath.Clean(path)
@@ -675,17 +1071,23 @@ func walkPathForUploads(localPath, drivePath string, encrypt,
 			return nil
 		}
 
-		// Get the file's path relative to the base directory we're
-		// uploading from.
-		relPath, err := filepath.Rel(localPath, path)
-		if err != nil {
-			return err
+		drivePath, driveName, nameProps := driveRoot, driveName, nameProps
+		if path != localPath {
+			parent, ok := dirDrivePaths[filepath.Dir(path)]
+			if !ok {
+				return fmt.Errorf("%s: parent directory not seen", path)
+			}
+			driveName, nameProps = driveNameForLocalName(path, parent)
+			drivePath = filepath.Join(parent, driveName)
 		}
-		drivePath := filepath.Join(drivePath, relPath)
+		if stat.IsDir() {
+			dirDrivePaths[path] = drivePath
+		}
+		var err error
 
-		if isSymlink(stat) {
+		if isSymlink(stat) && !opts.PreserveSymlinks {
 			// Follow symlinks up to the depth allowed.
-			maxDepth := maxSymlinkDepth
+			maxDepth := opts.MaxSymlinkDepth
 			path, stat, err = resolveSymlinks(path, stat, &maxDepth)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "skicka: %s\n", err)
@@ -694,33 +1096,31 @@ func walkPathForUploads(localPath, drivePath string, encrypt,
 			}
 
 			// We reached a non-symlink. Make a recursive call to
-			// walkPathForUploads in case we reached a directory; note that
-			// the maxDepth passed in accounts for the number of links we
+			// walkLocalPath in case we reached a directory; note that the
+			// maxDepth passed in accounts for the number of links we
 			// followed to get to this point.
-			mappings, ne := walkPathForUploads(path, drivePath, encrypt,
-				trustTimes, maxDepth, dryRun)
-			fileMappings = append(fileMappings, mappings...)
-			nErrs += ne
+			linkOpts := opts
+			linkOpts.MaxSymlinkDepth = maxDepth
+			nErrs += walkLocalPath(path, drivePath, driveName, nameProps,
+				linkOpts, visit)
 			return nil
 		}
 
-		if stat.IsDir() == false && encrypt == true {
+		if stat.IsDir() == false && !isSymlink(stat) && opts.Encrypt == true {
 			drivePath += encryptionSuffix
+			driveName += encryptionSuffix
 		}
 
-		upload, err := fileNeedsUpload(path, drivePath, stat, encrypt, trustTimes,
-			dryRun)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "skicka: %s\n", err)
-			nErrs++
-		} else if upload {
-			fileMappings = append(fileMappings,
-				localToRemoteFileMapping{path, drivePath, stat})
-		}
+		visit(localToRemoteFileMapping{
+			LocalPath:      path,
+			DrivePath:      drivePath,
+			LocalFileInfo:  stat,
+			DriveName:      driveName,
+			DriveNameProps: nameProps,
+		})
 
 		// Always return nil: we don't want to stop walking the
-		// hierarchy just because we hit an error deciding if one file
-		// needs to be uploaded.
+		// hierarchy just because we hit an error with one file.
 		return nil
 	}
 
@@ -728,67 +1128,165 @@ func walkPathForUploads(localPath, drivePath string, encrypt,
 		fmt.Fprintf(os.Stderr, "skicka: %s\n", err)
 		nErrs++
 	}
-	return fileMappings, nErrs
+	return nErrs
+}
+
+// isIgnoredForUpload returns true if the given local path matches one of
+// the regular expressions of files to ignore given in the config file.
+func isIgnoredForUpload(localPath string) (bool, error) {
+	// Skip temporary files from downloads that are in progress or were
+	// interrupted.
+	if strings.HasPrefix(filepath.Base(localPath), downloadTempPrefix) {
+		debug.Printf("%s: ignoring temporary download file", localPath)
+		return true, nil
+	}
+	for _, re := range config.Upload.Ignored_Regexp {
+		match, err := regexp.MatchString(re, localPath)
+		if match == true {
+			verbose.Printf("skicka: %s: ignoring file, which "+
+				"matches regexp \"%s\".\n", localPath, re)
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return false, nil
 }
 
-func compileUploadFileTree(localPath, drivePath string,
-	encrypt, trustTimes bool, maxSymlinkDepth int, dryRun bool) ([]localToRemoteFileMapping, int32) {
-	// Walk the local directory hierarchy starting at 'localPath' and build
-	// an array of files that may need to be synchronized.
+// fileNeedsUploadWithoutConflict calls fileNeedsUpload for the file in the
+// given mapping and then handles the case of the file being a sync
+// conflict, as described in syncstate.go.  Files that don't need to be
+// uploaded are noted as being in sync and added to the manifest.
+func fileNeedsUploadWithoutConflict(fm localToRemoteFileMapping,
+	opts uploadOptions) (bool, error) {
+	// Get the Drive file's metadata before fileNeedsUpload updates it.
+	driveFile, getErr := getDriveFile(fm.DrivePath)
+
+	if stat := fm.LocalFileInfo; !stat.IsDir() {
+		if excluded, reason := opts.Filter.excludes(stat.Size(), stat.ModTime()); excluded {
+			if opts.DryRun {
+				fmt.Printf("%s: skipped (%s)\n", fm.LocalPath, reason)
+			} else {
+				verbose.Printf("%s: skipping file, which is %s", fm.LocalPath, reason)
+			}
+			addToManifest(manifestEntryForFile(fm.LocalPath, fm.DrivePath, driveFile,
+				manifestSkipped, reason), nil)
+			return false, nil
+		}
+	}
+
+	metadataDiffers := getErr == nil && driveMetadataDiffers(fm.LocalFileInfo, driveFile)
+
+	upload, err := fileNeedsUpload(fm.LocalPath, fm.DrivePath, fm.LocalFileInfo, opts)
+	if err == nil && upload {
+		upload, err = resolveUploadConflict(fm, opts.Conflicts, opts.DryRun)
+	}
+	if err != nil {
+		if _, ok := err.(conflictError); ok {
+			addToManifest(manifestEntryForFile(fm.LocalPath, fm.DrivePath, driveFile,
+				manifestSkipped, "conflict"), err)
+		} else {
+			addToManifest(manifestEntryForFile(fm.LocalPath, fm.DrivePath, driveFile,
+				manifestFailed, ""), err)
+		}
+		return false, err
+	} else if upload {
+		return true, nil
+	}
+
+	action, reason := manifestSkipped, "up to date"
+	if ignored, _ := isIgnoredForUpload(fm.LocalPath); ignored {
+		reason = "ignored"
+	} else if getErr == gdrive.ErrMultipleFiles {
+		reason = "multiple files on Drive"
+	} else if metadataDiffers {
+		action, reason = manifestMetadataOnly, ""
+	}
+	addToManifest(manifestEntryForFile(fm.LocalPath, fm.DrivePath, driveFile,
+		action, reason), nil)
+
+	if getErr == nil && !opts.DryRun {
+		recordSyncIfUnchanged(fm.LocalPath, driveFile)
+	}
+	return false, nil
+}
+
+// driveMetadataDiffers returns true if the modification time or
+// permissions of the given Drive file don't match the local file's.
+func driveMetadataDiffers(stat os.FileInfo, f *gdrive.File) bool {
+	if isSymlink(stat) {
+		return false
+	}
+	perms, err := f.GetProperty("Permissions")
+	return err != nil || perms != fmt.Sprintf("%#o", stat.Mode()&os.ModePerm) ||
+		!normalizeModTime(stat.ModTime()).Equal(normalizeModTime(f.ModTime))
+}
+
+// compileUploadFileTree finds the files starting at localPath that need
+// to be uploaded to drivePath and sends them on toUploadChan.  It returns
+// the number of errors.
+func compileUploadFileTree(localPath, drivePath string, opts uploadOptions,
+	folders *driveFolders, toUploadChan chan<- localToRemoteFileMapping) int32 {
 	nUploadErrors := int32(0)
 
 	// If we're just uploading a single file, some of the details are
 	// different...
+	driveName := filepath.Base(drivePath)
+	var nameProps []gdrive.Property
 	if stat, err := os.Stat(localPath); err == nil && stat.IsDir() == false {
-		driveFile, err := gd.GetFile(drivePath)
+		driveFile, err := getDriveFile(drivePath)
 		switch err {
 		case nil:
 			if driveFile.IsFolder() {
 				// The local path is for a file and the Drive path is for a
 				// folder; update the drive path to end with the base of the
 				// local filename.
-				drivePath = filepath.Join(drivePath, filepath.Base(localPath))
+				driveName, nameProps = driveNameForLocalName(localPath, drivePath)
+				drivePath = filepath.Join(drivePath, driveName)
 			}
 		case gdrive.ErrNotExist:
 			// This is fine.
 		default:
 			fmt.Fprintf(os.Stderr, "skicka: %s: %s\n", drivePath, err)
-			return nil, 1
+			return 1
 		}
 
-		if encrypt {
+		if opts.Encrypt {
 			drivePath += encryptionSuffix
+			driveName += encryptionSuffix
 		}
 
 		if isSymlink(stat) {
-			localPath, stat, err = resolveSymlinks(localPath, stat, &maxSymlinkDepth)
+			localPath, stat, err = resolveSymlinks(localPath, stat, &opts.MaxSymlinkDepth)
 			if err != nil {
 				verbose.Printf("skicka: %s", err)
 				nUploadErrors++
-				return nil, nUploadErrors
+				return nUploadErrors
 			}
 		}
 
-		var fileMappings []localToRemoteFileMapping
-		upload, err := fileNeedsUpload(localPath, drivePath, stat,
-			encrypt, trustTimes, dryRun)
+		fm := localToRemoteFileMapping{
+			LocalPath:      localPath,
+			DrivePath:      drivePath,
+			LocalFileInfo:  stat,
+			DriveName:      driveName,
+			DriveNameProps: nameProps,
+		}
+		upload, err := fileNeedsUploadWithoutConflict(fm, opts)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "skicka: %s", err)
 			nUploadErrors++
 		} else if upload {
-			fileMappings = append(fileMappings,
-				localToRemoteFileMapping{localPath, drivePath, stat})
+			toUploadChan <- fm
 		}
-		return fileMappings, nUploadErrors
+		return nUploadErrors
 	}
 
-	message("Getting list of local files... ")
-	fileMappings, nErrs := walkPathForUploads(localPath, drivePath, encrypt,
-		trustTimes, maxSymlinkDepth, dryRun)
-	nUploadErrors += nErrs
-	message("Done.")
-
-	return fileMappings, nUploadErrors
+	message("Checking local files... ")
+	nUploadErrors += walkPathForUploads(localPath, drivePath, driveName,
+		nameProps, opts, folders, toUploadChan)
+	return nUploadErrors
 }
 
 // If we didn't shut down cleanly before, there may be files that
@@ -833,3 +1331,312 @@ func createMissingProperties(f *gdrive.File, mode os.FileMode, encrypt bool) err
 	}
 	return nil
 }
+
+// symlinkNeedsUpload is called by fileNeedsUpload() for symlinks that are
+// being preserved as links on Drive; it compares the link targets without
+// following the link.
+func symlinkNeedsUpload(localPath string, driveFile *gdrive.File, stat os.FileInfo,
+	dryRun bool) (bool, error) {
+	target, err := os.Readlink(localPath)
+	if err != nil {
+		return false, err
+	}
+	driveTarget, err := getSymlinkTarget(driveFile)
+	if err != nil || driveTarget != target {
+		debug.Printf("%s: link target changed to %s", localPath, target)
+		return true, nil
+	}
+
+	if dryRun {
+		return false, nil
+	}
+	return false, gd.UpdateModificationTime(driveFile, normalizeModTime(stat.ModTime()))
+}
+
+// syncSymlinkUp stores the target of the local symlink at localPath in a
+// property of the Drive file at drivePath, creating the file first if it
+// doesn't exist.
+func syncSymlinkUp(fm localToRemoteFileMapping,
+	parentFolder *gdrive.File) (*gdrive.File, error) {
+	localPath, drivePath := fm.LocalPath, fm.DrivePath
+	target, err := os.Readlink(localPath)
+	if err != nil {
+		return nil, err
+	}
+	if !utf8.ValidString(target) {
+		return nil, fmt.Errorf("%s: symlink target isn't valid UTF-8", localPath)
+	}
+
+	driveFile, err := getDriveFile(drivePath)
+	switch err {
+	case gdrive.ErrNotExist:
+		proplist := makeLongProperty(symlinkTargetProperty, target)
+		proplist = append(proplist, fm.DriveNameProps...)
+		driveFile, err = gd.CreateFileWithMimeType(fm.DriveName,
+			parentFolder, time.Unix(0, 0), proplist, symlinkMimeType)
+	case nil:
+		err = updateLongProperty(driveFile, symlinkTargetProperty, target)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	atomic.AddInt64(&stats.DriveFilesUpdated, 1)
+	verbose.Printf("Stored symlink %s -> %s", localPath, target)
+	return driveFile, nil
+}
+
+// movedFileMatcher matches local files that are being uploaded to new
+// locations on Drive with files under the Drive folder being uploaded to
+// that have the same contents but no longer exist locally; such files were
+// presumably moved or renamed locally, so they can be moved on Drive
+// instead of being uploaded again.
+type movedFileMatcher struct {
+	encrypt bool
+	// The Drive files that don't exist locally any more, indexed by
+	// their size.
+	candidates map[int64][]*gdrive.File
+	mutex      sync.Mutex
+	// Ids of the candidates that have already been matched.
+	used map[string]bool
+}
+
+// findMovedFileCandidates returns a movedFileMatcher for the files under
+// driveRoot that don't exist under localRoot any more, or nil if there
+// aren't any.
+func findMovedFileCandidates(localRoot, driveRoot string, encrypt bool) *movedFileMatcher {
+	// Moves are only detected when uploading a directory hierarchy.
+	if stat, err := os.Stat(localRoot); err != nil || !stat.IsDir() {
+		return nil
+	}
+	driveFiles, err := gd.GetFilesUnderFolder(driveRoot, false)
+	if err != nil {
+		return nil
+	}
+
+	localPathMap := createPathMap(driveFiles, localRoot, driveRoot)
+	candidates := make(map[int64][]*gdrive.File)
+	for _, f := range driveFiles {
+		if f.IsFolder() || f.IsGoogleAppsFile() || isSymlinkFile(f) ||
+			f.FileSize == 0 || f.Md5 == "" {
+			continue
+		}
+		if enc, _ := isEncrypted(f); enc != encrypt {
+			continue
+		}
+		localPath, ok := localPathMap[f.Path]
+		if !ok {
+			continue
+		}
+		if _, err := os.Lstat(localPath); os.IsNotExist(err) {
+			candidates[f.FileSize] = append(candidates[f.FileSize], f)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return &movedFileMatcher{encrypt: encrypt, candidates: candidates,
+		used: make(map[string]bool)}
+}
+
+// movedFrom returns the Drive file that can be moved to the Drive path in
+// the given mapping instead of uploading its local file, or nil if there
+// isn't one.  It may be called from multiple goroutines.
+func (m *movedFileMatcher) movedFrom(fm localToRemoteFileMapping) *gdrive.File {
+	if m == nil {
+		return nil
+	}
+	// Only files at new paths on Drive may have been moved.
+	if _, err := getDriveFile(fm.DrivePath); err != gdrive.ErrNotExist {
+		return nil
+	}
+	return m.match(fm)
+}
+
+// match returns the candidate that has the same contents as the local
+// file in the given mapping, if there's one that hasn't already been
+// matched with another file.
+func (m *movedFileMatcher) match(fm localToRemoteFileMapping) *gdrive.File {
+	stat := fm.LocalFileInfo
+	if stat.IsDir() || isSymlink(stat) || stat.Size() == 0 {
+		return nil
+	}
+
+	driveSize := stat.Size()
+	if m.encrypt {
+		driveSize += aes.BlockSize
+	}
+	// The MD5 of an encrypted file depends on its IV, so it has to be
+	// computed separately for each candidate.
+	var localMD5 string
+	var err error
+	for _, f := range m.candidates[driveSize] {
+		m.mutex.Lock()
+		used := m.used[f.Id]
+		m.mutex.Unlock()
+		if used {
+			continue
+		}
+		var iv []byte
+		if m.encrypt {
+			if iv, err = getInitializationVector(f); err != nil {
+				continue
+			}
+		}
+		if localMD5 == "" || m.encrypt {
+			if localMD5, err = localFileMD5Contents(fm.LocalPath, m.encrypt, iv); err != nil {
+				return nil
+			}
+		}
+		if localMD5 != f.Md5 {
+			continue
+		}
+
+		// Another file with the same contents may have claimed it since
+		// it was checked above.
+		m.mutex.Lock()
+		used = m.used[f.Id]
+		m.used[f.Id] = true
+		m.mutex.Unlock()
+		if !used {
+			debug.Printf("%s: same contents as %s, which was removed locally",
+				fm.LocalPath, f.Path)
+			return f
+		}
+	}
+	return nil
+}
+
+// moveDriveFile moves the given Drive file to the Drive path in the given
+// mapping and then updates its metadata to match the local file.
+func moveDriveFile(f *gdrive.File, fm localToRemoteFileMapping, opts uploadOptions) error {
+	parentFolder, err := getDriveFile(fm.driveParentPath())
+	if err != nil {
+		return err
+	}
+	fromPath := f.Path
+	f, err = gd.MoveFile(f, parentFolder, fm.DriveName)
+	if err != nil {
+		return err
+	}
+	if err := updateLocalNameProperty(f, fm.DriveNameProps); err != nil {
+		return err
+	}
+
+	stat := fm.LocalFileInfo
+	bitsString := fmt.Sprintf("%#o", stat.Mode()&os.ModePerm)
+	if err := gd.UpdateProperty(f, "Permissions", bitsString); err != nil {
+		return err
+	}
+	if opts.PreserveMetadata {
+		if err := updateMetadataProperties(f, fm.LocalPath, stat); err != nil {
+			return err
+		}
+	}
+	if err := gd.UpdateModificationTime(f, normalizeModTime(stat.ModTime())); err != nil {
+		return err
+	}
+
+	recordSync(fm.LocalPath, f, f.Md5, stat.ModTime())
+	addToManifest(manifestEntryForFile(fm.LocalPath, fm.DrivePath, f, manifestUpdated,
+		"moved from "+fromPath), nil)
+
+	atomic.AddInt64(&stats.DriveFilesUpdated, 1)
+	verbose.Printf("Moved Google Drive %s -> %s", fromPath, fm.DrivePath)
+	return nil
+}
+
+// copySources indexes the files on Drive by their size, for finding files
+// that can be copied when uploading with -copy-existing.  It's built the
+// first time it's needed.
+var copySources struct {
+	once  sync.Once
+	files map[int64][]*gdrive.File
+}
+
+// findCopySource looks for a file on Drive with the same contents as the
+// given local file.  If one is found, it's returned along with its IV, if
+// it's encrypted.
+func findCopySource(localPath string, stat os.FileInfo, encrypt bool) (*gdrive.File, []byte) {
+	copySources.once.Do(func() {
+		copySources.files = make(map[int64][]*gdrive.File)
+		driveFiles, err := gd.GetFilesUnderFolder("/", false)
+		if err != nil {
+			return
+		}
+		for _, f := range driveFiles {
+			if f.IsFolder() || f.IsGoogleAppsFile() || isSymlinkFile(f) ||
+				f.FileSize == 0 || f.Md5 == "" {
+				continue
+			}
+			copySources.files[f.FileSize] = append(copySources.files[f.FileSize], f)
+		}
+	})
+
+	driveSize := stat.Size()
+	if encrypt {
+		driveSize += aes.BlockSize
+	}
+	// As in movedFileMatcher.match, the MD5 of an encrypted file depends
+	// on its IV, so it has to be computed separately for each candidate.
+	var localMD5 string
+	for _, f := range copySources.files[driveSize] {
+		if enc, _ := isEncrypted(f); enc != encrypt {
+			continue
+		}
+		var iv []byte
+		var err error
+		if encrypt {
+			if iv, err = getInitializationVector(f); err != nil {
+				continue
+			}
+		}
+		if localMD5 == "" || encrypt {
+			if localMD5, err = localFileMD5Contents(localPath, encrypt, iv); err != nil {
+				return nil, nil
+			}
+		}
+		if localMD5 == f.Md5 {
+			debug.Printf("%s: same contents as %s", localPath, f.Path)
+			return f, iv
+		}
+	}
+	return nil, nil
+}
+
+// copyDriveFile creates the Drive file for the given mapping by copying
+// the given Drive file, which has the same contents, on the server.  The
+// copy is given the properties in proplist and the local file's
+// modification time.
+func copyDriveFile(source *gdrive.File, fm localToRemoteFileMapping,
+	parentFolder *gdrive.File, proplist []gdrive.Property) (*gdrive.File, error) {
+	stat := fm.LocalFileInfo
+	f, err := gd.CopyFile(source, fm.DriveName, parentFolder,
+		normalizeModTime(stat.ModTime()), proplist)
+	if err != nil {
+		return nil, err
+	}
+
+	// The copy may have inherited properties from the source file that
+	// don't apply to it (an original local name, say); remove them.
+	for _, prop := range f.Properties {
+		keep := false
+		for _, p := range proplist {
+			keep = keep || p.Key == prop.Key
+		}
+		if !keep {
+			if err := gd.DeleteProperty(f, prop.Key); err != nil {
+				return f, err
+			}
+		}
+	}
+	if err := gd.UpdateModificationTime(f, normalizeModTime(stat.ModTime())); err != nil {
+		return f, err
+	}
+
+	recordSync(fm.LocalPath, f, source.Md5, stat.ModTime())
+
+	atomic.AddInt64(&stats.DriveFilesUpdated, 1)
+	verbose.Printf("Copied Google Drive %s -> %s", source.Path, fm.DrivePath)
+	return f, nil
+}
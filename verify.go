@@ -0,0 +1,114 @@
+//
+// verify.go
+// Copyright(c)2014-2015 Google, Inc.
+//
+// This file is part of skicka.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"github.com/google/skicka/gdrive"
+	"hash"
+	"io"
+)
+
+// Downloaded contents are checked against the MD5 checksum that Drive
+// has for the file, so that truncated or corrupted transfers aren't taken
+// for successful ones.  The checksum is of the contents as stored on
+// Drive, i.e., before they're decrypted or decompressed.
+
+// Number of times that a file whose downloaded contents don't match its
+// checksum is downloaded again before giving up.
+const maxIntegrityRetries = 3
+
+// integrityError is returned when downloaded contents don't match the
+// MD5 checksum of the file on Drive.
+type integrityError struct {
+	expected, actual string
+}
+
+func (e integrityError) Error() string {
+	return fmt.Sprintf("downloaded contents have MD5 checksum %s, but it's %s "+
+		"on Drive", e.actual, e.expected)
+}
+
+func isIntegrityError(err error) bool {
+	_, ok := err.(integrityError)
+	return ok
+}
+
+// md5VerifyingReader computes the MD5 checksum of the contents read
+// through it; at EOF, it returns an integrityError instead of io.EOF if
+// they don't match the expected checksum.
+type md5VerifyingReader struct {
+	io.ReadCloser
+	md5      hash.Hash
+	expected string
+}
+
+// makeMD5VerifyingReader returns a reader that verifies the contents of
+// the given Drive file read from r, which must start at the beginning of
+// the file as stored on Drive.  Files without a checksum (Google Docs
+// files) aren't verified.
+func makeMD5VerifyingReader(f *gdrive.File, r io.ReadCloser) io.ReadCloser {
+	if f.Md5 == "" {
+		return r
+	}
+	return &md5VerifyingReader{ReadCloser: r, md5: md5.New(), expected: f.Md5}
+}
+
+func (r *md5VerifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.md5.Write(p[:n])
+	if err == io.EOF {
+		if actual := fmt.Sprintf("%x", r.md5.Sum(nil)); actual != r.expected {
+			return n, integrityError{expected: r.expected, actual: actual}
+		}
+	}
+	return n, err
+}
+
+// verifyDownloadedFile checks the contents of the local file at the given
+// path, which was downloaded from the given Drive file, against the file's
+// checksum.  It's used for downloads that didn't receive the contents in
+// a single stream.  Encrypted files are encrypted again to compute the
+// checksum; compressed files are never downloaded that way.
+func verifyDownloadedFile(localPath string, f *gdrive.File) error {
+	if f.Md5 == "" {
+		return nil
+	}
+	encrypted, err := isEncrypted(f)
+	if err != nil {
+		return err
+	}
+	var iv []byte
+	if encrypted {
+		if iv, err = getInitializationVector(f); err != nil {
+			return fmt.Errorf("unable to get IV: %v", err)
+		}
+	}
+	debug.Printf("%s: reading back downloaded contents to verify them", localPath)
+	actual, err := localFileMD5Contents(localPath, encrypted, iv)
+	if err != nil {
+		return err
+	}
+	if actual != f.Md5 {
+		return integrityError{expected: f.Md5, actual: actual}
+	}
+	return nil
+}